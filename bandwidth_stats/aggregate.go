@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// bucketFormat formats the start of buckets of --bucket width.
+const bucketFormat = "2006-01-02 15:04:05"
+
+// timeBuckets are group-by keys that truncate the capture time, formatted so
+// that they sort chronologically.
+var timeBuckets = map[string]func(t time.Time) string{
+	"bucket": func(t time.Time) string { return t.Truncate(*bucket).Format(bucketFormat) },
+	"minute": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"hour":   func(t time.Time) string { return t.Format("2006-01-02 15:00") },
+	"day":    func(t time.Time) string { return t.Format("2006-01-02") },
+	"month":  func(t time.Time) string { return t.Format("2006-01") },
+}
+
+// groupKey computes one column of the group-by key of a packet.
+type groupKey func(m *data.PacketMetadata) string
+
+func formatField(f field, m *data.PacketMetadata) string {
+	value := f.value(m)
+	switch v := value.(type) {
+	case time.Time:
+		return v.Local().Format(time.RFC3339Nano)
+	case net.IP:
+		if v == nil {
+			return ""
+		}
+	case net.HardwareAddr:
+		if v == nil {
+			return ""
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// ParseGroupBy parses a comma-separated list of fields and time buckets.
+func ParseGroupBy(s string) ([]string, []groupKey, error) {
+	var names []string
+	var keys []groupKey
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if bucket, ok := timeBuckets[name]; ok {
+			keys = append(keys, func(m *data.PacketMetadata) string {
+				return bucket(m.CaptureTime.Local())
+			})
+		} else if f, ok := fields[name]; ok {
+			keys = append(keys, func(m *data.PacketMetadata) string {
+				return formatField(f, m)
+			})
+		} else {
+			return nil, nil, fmt.Errorf("unknown group by field %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, keys, nil
+}
+
+type Row struct {
+	Keys    []string
+	Packets uint64
+	Bytes   uint64
+}
+
+// Aggregation sums packets matching a filter per group. Each worker has its
+// own, which are merged once decoding is done.
+type Aggregation struct {
+	filter Filter
+	keys   []groupKey
+	rows   map[string]*Row
+}
+
+func NewAggregation(filter Filter, keys []groupKey) *Aggregation {
+	return &Aggregation{
+		filter: filter,
+		keys:   keys,
+		rows:   make(map[string]*Row),
+	}
+}
+
+func (a *Aggregation) Add(m *data.PacketMetadata) {
+	if !a.filter.Match(m) {
+		return
+	}
+	values := make([]string, len(a.keys))
+	for i, key := range a.keys {
+		values[i] = key(m)
+	}
+	id := strings.Join(values, "\x00")
+	row, ok := a.rows[id]
+	if !ok {
+		row = &Row{Keys: values}
+		a.rows[id] = row
+	}
+	row.Packets++
+	row.Bytes += uint64(m.TotalSize - m.Layer1Size)
+}
+
+func (a *Aggregation) Merge(other *Aggregation) {
+	for id, o := range other.rows {
+		row, ok := a.rows[id]
+		if !ok {
+			row = &Row{Keys: o.Keys}
+			a.rows[id] = row
+		}
+		row.Packets += o.Packets
+		row.Bytes += o.Bytes
+	}
+}
+
+// Rows returns the groups sorted by sortBy, which is "bytes" or "packets" for
+// the largest first, or "key" for ascending group-by keys.
+func (a *Aggregation) Rows(sortBy string) ([]*Row, error) {
+	rows := make([]*Row, 0, len(a.rows))
+	for _, row := range a.rows {
+		rows = append(rows, row)
+	}
+	lessKeys := func(i, j int) bool {
+		for k := range rows[i].Keys {
+			if rows[i].Keys[k] != rows[j].Keys[k] {
+				return rows[i].Keys[k] < rows[j].Keys[k]
+			}
+		}
+		return false
+	}
+	switch sortBy {
+	case "bytes":
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Bytes != rows[j].Bytes {
+				return rows[i].Bytes > rows[j].Bytes
+			}
+			return lessKeys(i, j)
+		})
+	case "packets":
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Packets != rows[j].Packets {
+				return rows[i].Packets > rows[j].Packets
+			}
+			return lessKeys(i, j)
+		})
+	case "key":
+		sort.Slice(rows, lessKeys)
+	default:
+		return nil, fmt.Errorf("unknown sort order %q", sortBy)
+	}
+	return rows, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	chartWidth        = 960
+	chartHeight       = 400
+	chartMarginLeft   = 80
+	chartMarginRight  = 20
+	chartMarginTop    = 30
+	chartMarginBottom = 60
+	chartLegendLine   = 18
+	chartXTicks       = 8
+	chartYTicks       = 5
+)
+
+var chartColors = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+// formatBytes formats n with a binary unit prefix.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// chartBuckets returns the sorted time buckets of rows. Buckets of --bucket
+// width without any packets are filled in, so that they chart as zero.
+func chartBuckets(name string, rows []*Row) []string {
+	seen := make(map[string]bool)
+	var buckets []string
+	for _, row := range rows {
+		if !seen[row.Keys[0]] {
+			seen[row.Keys[0]] = true
+			buckets = append(buckets, row.Keys[0])
+		}
+	}
+	sort.Strings(buckets)
+	if name != "bucket" || len(buckets) < 2 {
+		return buckets
+	}
+	first, err := time.ParseInLocation(bucketFormat, buckets[0], time.Local)
+	if err != nil {
+		return buckets
+	}
+	last, err := time.ParseInLocation(bucketFormat, buckets[len(buckets)-1], time.Local)
+	if err != nil {
+		return buckets
+	}
+	var filled []string
+	for t := first; !t.After(last); t = t.Add(*bucket) {
+		filled = append(filled, t.Format(bucketFormat))
+	}
+	return filled
+}
+
+// writeChart writes a self-contained HTML page charting bytes over the time
+// buckets of the first group by key, with a line for each combination of
+// the other keys.
+func writeChart(w io.Writer, names []string, rows []*Row) error {
+	if len(names) == 0 || timeBuckets[names[0]] == nil {
+		return fmt.Errorf("--format=html needs the first of --group_by to be a time bucket")
+	}
+	buckets := chartBuckets(names[0], rows)
+	bucketIndex := make(map[string]int)
+	for i, b := range buckets {
+		bucketIndex[b] = i
+	}
+
+	values := make(map[string][]float64)
+	var series []string
+	var max float64
+	for _, row := range rows {
+		name := strings.Join(row.Keys[1:], " ")
+		if name == "" {
+			name = "all"
+		}
+		if _, ok := values[name]; !ok {
+			values[name] = make([]float64, len(buckets))
+			series = append(series, name)
+		}
+		v := values[name][bucketIndex[row.Keys[0]]] + float64(row.Bytes)
+		values[name][bucketIndex[row.Keys[0]]] = v
+		if v > max {
+			max = v
+		}
+	}
+	sort.Strings(series)
+	if max == 0 {
+		max = 1
+	}
+
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	plotHeight := float64(chartHeight - chartMarginTop - chartMarginBottom)
+	x := func(i int) float64 {
+		if len(buckets) < 2 {
+			return chartMarginLeft + plotWidth/2
+		}
+		return chartMarginLeft + plotWidth*float64(i)/float64(len(buckets)-1)
+	}
+	y := func(v float64) float64 {
+		return chartMarginTop + plotHeight*(1-v/max)
+	}
+	height := chartHeight + chartLegendLine*len(series)
+
+	title := "Bytes per " + names[0]
+	if names[0] == "bucket" {
+		title = fmt.Sprintf("Bytes per %v", *bucket)
+	}
+	if len(names) > 1 {
+		title += " by " + strings.Join(names[1:], ", ")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", html.EscapeString(title))
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n", chartWidth, height)
+	fmt.Fprintf(&b, "<text x=\"%d\" y=\"18\" font-size=\"14\">%s</text>\n", chartMarginLeft, html.EscapeString(title))
+
+	for i := 0; i <= chartYTicks; i++ {
+		v := max * float64(i) / chartYTicks
+		fmt.Fprintf(&b, "<line x1=\"%d\" y1=\"%.1f\" x2=\"%d\" y2=\"%.1f\" stroke=\"#ddd\"/>\n",
+			chartMarginLeft, y(v), chartWidth-chartMarginRight, y(v))
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%.1f\" text-anchor=\"end\">%s</text>\n",
+			chartMarginLeft-6, y(v)+4, formatBytes(v))
+	}
+	step := (len(buckets) + chartXTicks - 1) / chartXTicks
+	if step < 1 {
+		step = 1
+	}
+	for i := 0; i < len(buckets); i += step {
+		fmt.Fprintf(&b, "<line x1=\"%.1f\" y1=\"%d\" x2=\"%.1f\" y2=\"%d\" stroke=\"#999\"/>\n",
+			x(i), chartHeight-chartMarginBottom, x(i), chartHeight-chartMarginBottom+5)
+		fmt.Fprintf(&b, "<text x=\"%.1f\" y=\"%d\" text-anchor=\"middle\">%s</text>\n",
+			x(i), chartHeight-chartMarginBottom+20, html.EscapeString(buckets[i]))
+	}
+	fmt.Fprintf(&b, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"#999\"/>\n",
+		chartMarginLeft, chartHeight-chartMarginBottom, chartWidth-chartMarginRight, chartHeight-chartMarginBottom)
+
+	for i, name := range series {
+		color := chartColors[i%len(chartColors)]
+		points := make([]string, len(buckets))
+		for j, v := range values[name] {
+			points[j] = fmt.Sprintf("%.1f,%.1f", x(j), y(v))
+		}
+		fmt.Fprintf(&b, "<polyline fill=\"none\" stroke=\"%s\" stroke-width=\"1.5\" points=\"%s\"/>\n",
+			color, strings.Join(points, " "))
+		legendY := chartHeight + chartLegendLine*i
+		fmt.Fprintf(&b, "<rect x=\"%d\" y=\"%d\" width=\"12\" height=\"12\" fill=\"%s\"/>\n",
+			chartMarginLeft, legendY-10, color)
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\">%s</text>\n", chartMarginLeft+18, legendY, html.EscapeString(name))
+	}
+	b.WriteString("</svg>\n</body>\n</html>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// localMACs are the hardware addresses of the device the recording was
+// taken on, as given by --local_mac.
+var localMACs = map[string]bool{}
+
+func parseLocalMACs(s string) error {
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		addr, err := net.ParseMAC(spec)
+		if err != nil {
+			return err
+		}
+		localMACs[string(addr)] = true
+	}
+	return nil
+}
+
+// direction classifies a packet as the recorder does: tx if sent by the
+// local device, rx if sent to it, and unknown otherwise.
+func direction(m *data.PacketMetadata) string {
+	switch {
+	case localMACs[string(m.SrcMAC)]:
+		return "tx"
+	case localMACs[string(m.DstMAC)]:
+		return "rx"
+	}
+	return "unknown"
+}
+
+// device is the hardware address of the other end of a packet to or from the
+// local device; on a LAN recording, the device using the network. It is the
+// source address for packets of unknown direction.
+func device(m *data.PacketMetadata) net.HardwareAddr {
+	if localMACs[string(m.SrcMAC)] {
+		return m.DstMAC
+	}
+	return m.SrcMAC
+}
@@ -3,38 +3,93 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
-	"errors"
 	"flag"
+	"github.com/interarticle/bandwidth_recorder/columnar"
 	"github.com/interarticle/bandwidth_recorder/data"
+	"github.com/interarticle/bandwidth_recorder/recording"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-var gobFile = flag.String("recording", "", "Path to the recorded gob file")
+var (
+	gobFile = flag.String("recording", "", "Comma-separated paths to recordings, gob files optionally gzipped or columnar files, or - for stdin")
+	filter  = flag.String("filter", "", "Expression selecting the packets to count, e.g. \"dst_port == 443 and src_ip in 10.0.0.0/8\". "+
+		"Fields are time, size, total_size, layer{1,2,3}_size, layer{1,2,3}_type, src_mac, dst_mac, src_ip, dst_ip, src_port, dst_port, "+
+		"and with --local_mac, direction (tx, rx or unknown) and device (the hardware address at the other end); "+
+		"they are compared with ==, !=, <, <=, >, >= or, for IP addresses, in a CIDR network, and combined with and, or, not and parentheses.")
+	groupBy = flag.String("group_by", "", "Comma-separated fields by which to break down the count, which may include the time buckets minute, hour, day, month and bucket, e.g. \"src_mac,hour\". "+
+		"With --format=html, the first must be a time bucket, and the others distinguish the series charted.")
+	bucket   = flag.Duration("bucket", time.Minute, "Width of the time bucket named bucket in --group_by.")
+	localMAC = flag.String("local_mac", "", "Comma-separated hardware addresses of the device the recording was taken on, by which packets are given a direction and device.")
+	sortBy   = flag.String("sort", "bytes", "Order of the output: bytes or packets for the largest first, or key for ascending group by fields.")
+	limit    = flag.Int("limit", 0, "Maximum number of rows to output; 0 for all.")
+	format   = flag.String("format", "text", "Output format: text, csv, json, or html for a chart of bytes over time.")
+	from     = flag.String("from", "", "Only count packets captured at or after this time, e.g. \"2024-01-31 18:00\" in local time or RFC 3339.")
+	to       = flag.String("to", "", "Only count packets captured before this time, in the same format as --from.")
+)
 
-func ReadGobUint32(reader io.Reader) (uint32, error) {
-	var buffer [4]byte
-	_, err := reader.Read(buffer[3:])
-	if err != nil {
-		return 0, err
+// maxMessageSize bounds the size of gob messages in a recording, so that
+// damaged lengths are recognized as such.
+const maxMessageSize = 1 << 16
+
+// parseGobUint decodes a gob unsigned integer at the start of b, returning
+// the number of bytes it took.
+func parseGobUint(b []byte) (value uint64, n int, ok bool) {
+	if len(b) == 0 {
+		return 0, 0, false
 	}
-	if buffer[3]&0x80 != 0 {
-		byteCount := ^buffer[3] + 1
-		if byteCount > 4 {
-			return 0, errors.New("excessive byte count")
-		}
-		_, err = io.ReadFull(reader, buffer[4-byteCount:])
-		if err != nil {
-			return 0, err
-		}
+	if b[0] < 0x80 {
+		return uint64(b[0]), 1, true
+	}
+	count := 256 - int(b[0])
+	if count > 8 || len(b) < 1+count {
+		return 0, 0, false
+	}
+	for _, c := range b[1 : 1+count] {
+		value = value<<8 | uint64(c)
+	}
+	return value, 1 + count, true
+}
+
+// parseGobInt decodes a gob signed integer, whose lowest bit is the sign.
+func parseGobInt(b []byte) (int64, bool) {
+	u, _, ok := parseGobUint(b)
+	if u&1 != 0 {
+		return ^int64(u >> 1), ok
 	}
-	return binary.BigEndian.Uint32(buffer[:]), nil
+	return int64(u >> 1), ok
+}
+
+// peekMessage returns the gob message at the start of reader without
+// consuming it, along with its type id, which is negative for type records.
+// ok is false if no complete message starts there, in which case err is set
+// once reader has no data left.
+func peekMessage(reader *bufio.Reader) (message []byte, typeID int64, ok bool, err error) {
+	prefix, err := reader.Peek(2 * (1 + 8))
+	if len(prefix) == 0 {
+		return nil, 0, false, err
+	}
+	length, n, ok := parseGobUint(prefix)
+	if !ok || length == 0 || length > maxMessageSize {
+		return nil, 0, false, nil
+	}
+	typeID, ok = parseGobInt(prefix[n:])
+	if !ok || typeID == 0 {
+		return nil, 0, false, nil
+	}
+	message, _ = reader.Peek(n + int(length))
+	if len(message) < n+int(length) {
+		return nil, 0, false, nil
+	}
+	return message, typeID, true, nil
 }
 
 type ByteChannelReader struct {
@@ -54,10 +109,31 @@ func (r *ByteChannelReader) Read(b []byte) (int, error) {
 	return r.reader.Read(b)
 }
 
+// SkipMessage drops the rest of the message being read.
+func (r *ByteChannelReader) SkipMessage() {
+	r.reader = nil
+}
+
+// GobMapper splits a gob stream into messages, passing the type records at
+// its start to every registered reader and each data record to one of them.
+// Damaged parts of the stream, including any type records after the first
+// data record, are skipped: the mapper scans forward to the next position
+// holding a message that decodes.
 type GobMapper struct {
 	reader          io.Reader
 	privateChannels []chan []byte
 	sharedChannel   chan []byte
+
+	// header holds the type records, and dataTypeID the type id of data
+	// records, once the first data record was read.
+	header     []byte
+	dataTypeID int64
+
+	dataRecords        uint64
+	dataBytes          uint64
+	lostBytes          uint64
+	damagedRegions     uint64
+	undecodableRecords uint64
 }
 
 func NewGobMapper(reader io.Reader) *GobMapper {
@@ -67,7 +143,7 @@ func NewGobMapper(reader io.Reader) *GobMapper {
 	}
 }
 
-func (g *GobMapper) RegisterReader() io.Reader {
+func (g *GobMapper) RegisterReader() *ByteChannelReader {
 	ch := make(chan []byte)
 	g.privateChannels = append(g.privateChannels, ch)
 	go func() {
@@ -81,101 +157,376 @@ func (g *GobMapper) RegisterReader() io.Reader {
 	}
 }
 
+// decodes reports whether message decodes as a packet following the type
+// records.
+func (g *GobMapper) decodes(message []byte) bool {
+	if g.header == nil {
+		return false
+	}
+	decoder := gob.NewDecoder(io.MultiReader(bytes.NewReader(g.header), bytes.NewReader(message)))
+	var metadata data.PacketMetadata
+	return decoder.Decode(&metadata) == nil
+}
+
 func (g *GobMapper) Start() {
 	go func() {
 		defer close(g.sharedChannel)
-		encounteredFirstRecord := false
+		reader := bufio.NewReaderSize(g.reader, 2*maxMessageSize)
+		var offset int64
+		resynchronizing := false
 		for {
-			buffer := new(bytes.Buffer)
-			reader := io.TeeReader(g.reader, buffer)
-			length, err := ReadGobUint32(reader)
-			if err != nil {
-				if err == io.EOF {
-					return
+			message, typeID, ok, err := peekMessage(reader)
+			if !ok && err != nil {
+				if err != io.EOF {
+					log.Printf("Failed to read recording: %v", err)
 				}
-				log.Printf("Failed to read length: %v", err)
-				return
-			}
-			headerByteCount := buffer.Len()
-			typeId, err := ReadGobUint32(reader)
-			if err != nil {
-				log.Printf("Failed to read type id: %v", err)
-				return
+				break
 			}
-			remainingToRead := length - uint32(buffer.Len()-headerByteCount)
-			if remainingToRead < 0 {
-				log.Printf("Invalid gob item size")
-				return
-			}
-			n, err := buffer.ReadFrom(io.LimitReader(g.reader, int64(remainingToRead)))
-			if err != nil {
-				log.Printf("Failed to read item: %v", err)
-				return
-			}
-			if n < int64(remainingToRead) {
-				log.Printf("short read item body")
-				return
+
+			accepted := false
+			switch {
+			case !ok:
+			case typeID < 0 && g.dataTypeID == 0:
+				accepted = true
+				g.header = append(g.header, message...)
+				for _, ch := range g.privateChannels {
+					ch <- append([]byte(nil), message...)
+				}
+			case typeID > 0 && (g.dataTypeID == 0 || typeID == g.dataTypeID) && (!resynchronizing || g.decodes(message)):
+				accepted = true
+				g.dataTypeID = typeID
+				g.dataRecords++
+				g.dataBytes += uint64(len(message))
+				g.sharedChannel <- append([]byte(nil), message...)
 			}
 
-			if typeId&1 != 0 {
-				if !encounteredFirstRecord {
-					for _, ch := range g.privateChannels {
-						ch <- buffer.Bytes()
-					}
-				} else {
-					log.Printf("Dropped type record %d after first data record",
-						typeId)
+			if !accepted {
+				if !resynchronizing {
+					log.Printf("Damaged record at offset %d; resynchronizing", offset)
+					resynchronizing = true
+					g.damagedRegions++
 				}
-			} else {
-				encounteredFirstRecord = true
-				g.sharedChannel <- buffer.Bytes()
+				reader.Discard(1)
+				offset++
+				g.lostBytes++
+				continue
+			}
+			if resynchronizing {
+				log.Printf("Resynchronized at offset %d", offset)
+				resynchronizing = false
 			}
+			reader.Discard(len(message))
+			offset += int64(len(message))
+		}
+		if resynchronizing {
+			log.Printf("Recording ends in a damaged or truncated record")
 		}
 	}()
 }
 
-func main() {
-	flag.Parse()
-	if *gobFile == "" {
-		log.Fatal("you must specify --recording")
+// Decode decodes the packets passed to r, calling handle for each. A record
+// that fails to decode is counted and skipped, decoding resuming with the
+// next one on a fresh decoder primed with the type records.
+func (g *GobMapper) Decode(r *ByteChannelReader, handle func(m *data.PacketMetadata)) {
+	decoder := gob.NewDecoder(r)
+	for {
+		var metadata data.PacketMetadata
+		err := decoder.Decode(&metadata)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			atomic.AddUint64(&g.undecodableRecords, 1)
+			r.SkipMessage()
+			// The header is complete once data records are passed on.
+			decoder = gob.NewDecoder(io.MultiReader(bytes.NewReader(g.header), r))
+			continue
+		}
+		handle(&metadata)
+	}
+}
+
+// LostRecords estimates the number of records lost to damage, from the
+// number of bytes skipped and the average size of intact records.
+func (g *GobMapper) LostRecords() uint64 {
+	lost := g.damagedRegions
+	if g.dataRecords > 0 {
+		estimate := (g.lostBytes*g.dataRecords + g.dataBytes/2) / g.dataBytes
+		if estimate > lost {
+			lost = estimate
+		}
 	}
+	return lost + atomic.LoadUint64(&g.undecodableRecords)
+}
+
+// Report logs how much of the recording was lost, if any. It must be called
+// once all readers are done.
+func (g *GobMapper) Report() {
+	if g.lostBytes == 0 && g.undecodableRecords == 0 {
+		return
+	}
+	log.Printf("Lost about %d records: skipped %d bytes in %d damaged regions, and %d records failed to decode",
+		g.LostRecords(), g.lostBytes, g.damagedRegions, g.undecodableRecords)
+}
+
+type closers []io.Closer
+
+func (c closers) Close() error {
 	var err error
-	var srcFile io.Reader
-	if *gobFile == "-" {
-		srcFile = os.Stdin
-	} else {
-		srcFile, err = os.Open(*gobFile)
+	for _, closer := range c {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openRange returns a reader over the part of a recording holding the
+// packets captured in [from, to) according to its index, preceded by the
+// header of the recording so that it decodes on its own.
+func openRange(path string, index *recording.Index, from, to time.Time) (io.Reader, io.Closer, error) {
+	start, end := index.Range(from, to)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	var segments io.Reader = file
+	if end >= 0 {
+		segments = io.LimitReader(file, end-start)
+	}
+	segments, err = recording.Decompress(segments)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if start == 0 {
+		return segments, file, nil
+	}
+
+	headerFile, err := os.Open(path)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	header, err := recording.Decompress(headerFile)
+	if err != nil {
+		file.Close()
+		headerFile.Close()
+		return nil, nil, err
+	}
+	reader := io.MultiReader(io.LimitReader(header, index.HeaderSize), segments)
+	return reader, closers{file, headerFile}, nil
+}
+
+// openRecording returns a reader over a recording, decompressing it if it
+// was gzipped, and whether it is in the columnar format. If from or to is set
+// and a gob recording has an index, only the part of it around [from, to) is
+// read.
+func openRecording(path string, from, to time.Time) (io.Reader, io.Closer, bool, error) {
+	if path == "-" {
+		reader, err := recording.Decompress(os.Stdin)
+		return reader, os.Stdin, err == nil && recording.IsColumnar(reader), err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	reader, err := recording.Decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, false, err
+	}
+	if recording.IsColumnar(reader) {
+		// Columnar files are read unbuffered so that chunks are skipped by
+		// seeking over them.
+		_, err = file.Seek(0, io.SeekStart)
 		if err != nil {
-			log.Fatal(err)
+			file.Close()
+			return nil, nil, false, err
+		}
+		return file, file, true, nil
+	}
+	if !from.IsZero() || !to.IsZero() {
+		index, err := recording.ReadIndex(path)
+		if err == nil {
+			file.Close()
+			reader, closer, err := openRange(path, index, from, to)
+			return reader, closer, false, err
+		}
+		if !os.IsNotExist(err) {
+			file.Close()
+			return nil, nil, false, err
 		}
+		log.Printf("%s has no index; reading all of it", path)
 	}
-	mapper := NewGobMapper(bufio.NewReader(srcFile))
+	return reader, file, false, nil
+}
 
-	var totalSize uint64 = 0
+// processColumnar decodes the chunks of a columnar recording across workers,
+// skipping those which cannot match the filter, and merges their
+// aggregations into total.
+func processColumnar(srcFile io.Reader, total *Aggregation) error {
+	reader, err := columnar.NewReader(srcFile)
+	if err != nil {
+		return err
+	}
+	chunks := make(chan *columnar.Chunk, runtime.NumCPU()*3)
 	var wg sync.WaitGroup
+	var aggregations []*Aggregation
 	for i := 0; i < runtime.NumCPU()-1 || i < 1; i++ {
 		wg.Add(1)
-		go func(mapperReader io.Reader) {
+		aggregation := NewAggregation(total.filter, total.keys)
+		aggregations = append(aggregations, aggregation)
+		go func() {
 			defer wg.Done()
-			var metadata data.PacketMetadata
-			reader := gob.NewDecoder(mapperReader)
-			for {
-				err := reader.Decode(&metadata)
+			for chunk := range chunks {
+				rows, err := chunk.Decode()
 				if err != nil {
-					if err == io.EOF {
-						break
-					}
 					log.Printf("Decoding failed: %v", err)
-					break
+					continue
+				}
+				for i := range rows {
+					aggregation.Add(&rows[i])
 				}
-				atomic.AddUint64(&totalSize, uint64(metadata.TotalSize-metadata.Layer1Size))
 			}
+		}()
+	}
+
+	skipped := 0
+	mayMatch := func(stats *columnar.Stats) bool {
+		if total.filter.MayMatch(stats) {
+			return true
+		}
+		skipped++
+		return false
+	}
+	for {
+		var chunk *columnar.Chunk
+		chunk, err = reader.Next(mayMatch)
+		if err != nil {
+			break
+		}
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+	for _, aggregation := range aggregations {
+		total.Merge(aggregation)
+	}
+	log.Printf("Skipped %d chunks", skipped)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// processRecording decodes a single gob stream across workers, each adding
+// packets to its own aggregation, and merges them into total.
+func processRecording(srcFile io.Reader, total *Aggregation) {
+	mapper := NewGobMapper(srcFile)
+
+	var wg sync.WaitGroup
+	var aggregations []*Aggregation
+	for i := 0; i < runtime.NumCPU()-1 || i < 1; i++ {
+		wg.Add(1)
+		aggregation := NewAggregation(total.filter, total.keys)
+		aggregations = append(aggregations, aggregation)
+		go func(mapperReader *ByteChannelReader) {
+			defer wg.Done()
+			mapper.Decode(mapperReader, aggregation.Add)
 		}(mapper.RegisterReader())
 	}
-	log.Printf("Starting")
 	mapper.Start()
 	wg.Wait()
+	mapper.Report()
+	for _, aggregation := range aggregations {
+		total.Merge(aggregation)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		repairMain(os.Args[2:])
+		return
+	}
+	flag.Parse()
+	if *gobFile == "" {
+		log.Fatal("you must specify --recording")
+	}
+
+	if *bucket <= 0 {
+		log.Fatal("--bucket must be positive")
+	}
+	err := parseLocalMACs(*localMAC)
+	if err != nil {
+		log.Fatalf("Invalid --local_mac: %v", err)
+	}
+	packetFilter, err := ParseFilter(*filter)
+	if err != nil {
+		log.Fatalf("Invalid --filter: %v", err)
+	}
+	var fromTime, toTime time.Time
+	if *from != "" {
+		fromTime, err = parseTime(*from)
+		if err != nil {
+			log.Fatalf("Invalid --from: %v", err)
+		}
+		packetFilter = andFilter{&comparison{name: "time", field: fields["time"], op: ">=", value: fromTime}, packetFilter}
+	}
+	if *to != "" {
+		toTime, err = parseTime(*to)
+		if err != nil {
+			log.Fatalf("Invalid --to: %v", err)
+		}
+		packetFilter = andFilter{&comparison{name: "time", field: fields["time"], op: "<", value: toTime}, packetFilter}
+	}
+	names, keys, err := ParseGroupBy(*groupBy)
+	if err != nil {
+		log.Fatalf("Invalid --group_by: %v", err)
+	}
+	total := NewAggregation(packetFilter, keys)
+	// Catch typos before what may be a long decode.
+	if _, err := total.Rows(*sortBy); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeRows(ioutil.Discard, *format, names, nil); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Starting")
+	// Files are decoded one after another, since every gob file is its own
+	// stream with its own type records.
+	for _, path := range strings.Split(*gobFile, ",") {
+		srcFile, closer, isColumnar, err := openRecording(path, fromTime, toTime)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if isColumnar {
+			err = processColumnar(srcFile, total)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			processRecording(srcFile, total)
+		}
+		closer.Close()
+	}
 	log.Printf("Done")
 
-	log.Printf("Total size: %d", totalSize)
+	rows, err := total.Rows(*sortBy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *limit > 0 && len(rows) > *limit {
+		rows = rows[:*limit]
+	}
+	err = writeRows(os.Stdout, *format, names, rows)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func writeText(w io.Writer, names []string, rows []*Row) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	header := append(append([]string(nil), names...), "packets", "bytes")
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, row := range rows {
+		cells := append(append([]string(nil), row.Keys...),
+			strconv.FormatUint(row.Packets, 10), strconv.FormatUint(row.Bytes, 10))
+		fmt.Fprintln(tw, strings.Join(cells, "\t")+"\t")
+	}
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, names []string, rows []*Row) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(append(append([]string(nil), names...), "packets", "bytes"))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := append(append([]string(nil), row.Keys...),
+			strconv.FormatUint(row.Packets, 10), strconv.FormatUint(row.Bytes, 10))
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeJSON(w io.Writer, names []string, rows []*Row) error {
+	objects := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		object := map[string]interface{}{
+			"packets": row.Packets,
+			"bytes":   row.Bytes,
+		}
+		for k, name := range names {
+			object[name] = row.Keys[k]
+		}
+		objects[i] = object
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(objects)
+}
+
+func writeRows(w io.Writer, format string, names []string, rows []*Row) error {
+	switch format {
+	case "text":
+		return writeText(w, names, rows)
+	case "csv":
+		return writeCSV(w, names, rows)
+	case "json":
+		return writeJSON(w, names, rows)
+	case "html":
+		return writeChart(w, names, rows)
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
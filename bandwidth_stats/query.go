@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	// Registers the names of layer types.
+	_ "github.com/google/gopacket/layers"
+
+	"github.com/interarticle/bandwidth_recorder/columnar"
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+type fieldKind int
+
+const (
+	kindNumber fieldKind = iota
+	kindTime
+	kindIP
+	kindMAC
+	kindString
+)
+
+// field is a property of a PacketMetadata that can be filtered and grouped
+// by.
+type field struct {
+	kind  fieldKind
+	value func(m *data.PacketMetadata) interface{}
+}
+
+func numberField(value func(m *data.PacketMetadata) int) field {
+	return field{kindNumber, func(m *data.PacketMetadata) interface{} { return int64(value(m)) }}
+}
+
+var fields = map[string]field{
+	"time": {kindTime, func(m *data.PacketMetadata) interface{} { return m.CaptureTime }},
+	// size is what bandwidth_stats has always summed: the packet without its
+	// outermost header.
+	"size":        numberField(func(m *data.PacketMetadata) int { return m.TotalSize - m.Layer1Size }),
+	"total_size":  numberField(func(m *data.PacketMetadata) int { return m.TotalSize }),
+	"layer1_size": numberField(func(m *data.PacketMetadata) int { return m.Layer1Size }),
+	"layer2_size": numberField(func(m *data.PacketMetadata) int { return m.Layer2Size }),
+	"layer3_size": numberField(func(m *data.PacketMetadata) int { return m.Layer3Size }),
+	"src_port":    numberField(func(m *data.PacketMetadata) int { return int(m.SrcPort) }),
+	"dst_port":    numberField(func(m *data.PacketMetadata) int { return int(m.DstPort) }),
+	"layer1_type": {kindString, func(m *data.PacketMetadata) interface{} { return m.Layer1Type.String() }},
+	"layer2_type": {kindString, func(m *data.PacketMetadata) interface{} { return m.Layer2Type.String() }},
+	"layer3_type": {kindString, func(m *data.PacketMetadata) interface{} { return m.Layer3Type.String() }},
+	"src_mac":     {kindMAC, func(m *data.PacketMetadata) interface{} { return m.SrcMAC }},
+	"dst_mac":     {kindMAC, func(m *data.PacketMetadata) interface{} { return m.DstMAC }},
+	"src_ip":      {kindIP, func(m *data.PacketMetadata) interface{} { return m.SrcIP }},
+	"dst_ip":      {kindIP, func(m *data.PacketMetadata) interface{} { return m.DstIP }},
+	"direction":   {kindString, func(m *data.PacketMetadata) interface{} { return direction(m) }},
+	"device":      {kindMAC, func(m *data.PacketMetadata) interface{} { return device(m) }},
+}
+
+// Filter selects packets.
+type Filter interface {
+	Match(m *data.PacketMetadata) bool
+	// MayMatch reports whether any packet of a columnar chunk with stats
+	// may match, i.e. false only if none can.
+	MayMatch(stats *columnar.Stats) bool
+}
+
+type andFilter struct{ a, b Filter }
+
+func (f andFilter) Match(m *data.PacketMetadata) bool { return f.a.Match(m) && f.b.Match(m) }
+
+func (f andFilter) MayMatch(stats *columnar.Stats) bool {
+	return f.a.MayMatch(stats) && f.b.MayMatch(stats)
+}
+
+type orFilter struct{ a, b Filter }
+
+func (f orFilter) Match(m *data.PacketMetadata) bool { return f.a.Match(m) || f.b.Match(m) }
+
+func (f orFilter) MayMatch(stats *columnar.Stats) bool {
+	return f.a.MayMatch(stats) || f.b.MayMatch(stats)
+}
+
+type notFilter struct{ a Filter }
+
+func (f notFilter) Match(m *data.PacketMetadata) bool { return !f.a.Match(m) }
+
+// MayMatch is always true, since a chunk in which some packet may match a
+// may still have others that do not.
+func (f notFilter) MayMatch(stats *columnar.Stats) bool { return true }
+
+type allFilter struct{}
+
+func (allFilter) Match(m *data.PacketMetadata) bool { return true }
+
+func (allFilter) MayMatch(stats *columnar.Stats) bool { return true }
+
+// comparison compares a field to a constant, or checks that an IP field is
+// within a network for the "in" operator.
+type comparison struct {
+	name  string
+	field field
+	op    string
+	value interface{}
+}
+
+func compareResult(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func (c *comparison) Match(m *data.PacketMetadata) bool {
+	value := c.field.value(m)
+	switch c.field.kind {
+	case kindNumber:
+		a, b := value.(int64), c.value.(int64)
+		cmp := 0
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+		return compareResult(c.op, cmp)
+	case kindTime:
+		a, b := value.(time.Time), c.value.(time.Time)
+		cmp := 0
+		if a.Before(b) {
+			cmp = -1
+		} else if a.After(b) {
+			cmp = 1
+		}
+		return compareResult(c.op, cmp)
+	case kindIP:
+		ip := value.(net.IP)
+		if c.op == "in" {
+			return ip != nil && c.value.(*net.IPNet).Contains(ip)
+		}
+		return (c.op == "==") == ip.Equal(c.value.(net.IP))
+	case kindMAC:
+		return (c.op == "==") == bytes.Equal(value.(net.HardwareAddr), c.value.(net.HardwareAddr))
+	case kindString:
+		return (c.op == "==") == strings.EqualFold(value.(string), c.value.(string))
+	}
+	return false
+}
+
+// rangeMayCompare reports whether some value within [min, max] may compare
+// to value by op.
+func rangeMayCompare(op string, min, max, value int64) bool {
+	switch op {
+	case "==":
+		return min <= value && value <= max
+	case "!=":
+		return min != value || max != value
+	case "<":
+		return min < value
+	case "<=":
+		return min <= value
+	case ">":
+		return max > value
+	case ">=":
+		return max >= value
+	}
+	return true
+}
+
+func (c *comparison) MayMatch(stats *columnar.Stats) bool {
+	if stats.Rows == 0 {
+		return false
+	}
+	switch c.name {
+	case "time":
+		return rangeMayCompare(c.op, stats.MinTime, stats.MaxTime, c.value.(time.Time).UnixNano())
+	case "total_size":
+		return rangeMayCompare(c.op, int64(stats.MinTotalSize), int64(stats.MaxTotalSize), c.value.(int64))
+	case "src_port":
+		return rangeMayCompare(c.op, int64(stats.MinSrcPort), int64(stats.MaxSrcPort), c.value.(int64))
+	case "dst_port":
+		return rangeMayCompare(c.op, int64(stats.MinDstPort), int64(stats.MaxDstPort), c.value.(int64))
+	case "src_ip", "dst_ip":
+		var network *net.IPNet
+		switch c.op {
+		case "in":
+			network = c.value.(*net.IPNet)
+		case "==":
+			ip := c.value.(net.IP)
+			bits := 8 * len(ip)
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		default:
+			return true
+		}
+		if c.name == "src_ip" {
+			return stats.SrcIPMayBeIn(network)
+		}
+		return stats.DstIPMayBeIn(network)
+	}
+	return true
+}
+
+var timeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime accepts RFC 3339 times, or times without a zone in local time
+// with as little precision as a date.
+func parseTime(s string) (time.Time, error) {
+	for _, format := range timeFormats {
+		t, err := time.ParseInLocation(format, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+func parseValue(kind fieldKind, op string, s string) (interface{}, error) {
+	if op == "in" {
+		if kind != kindIP {
+			return nil, fmt.Errorf("\"in\" only applies to IP addresses")
+		}
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	if op != "==" && op != "!=" && kind != kindNumber && kind != kindTime {
+		return nil, fmt.Errorf("operator %s does not apply to %q", op, s)
+	}
+	switch kind {
+	case kindNumber:
+		return strconv.ParseInt(s, 0, 64)
+	case kindTime:
+		return parseTime(s)
+	case kindIP:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		return ip, nil
+	case kindMAC:
+		return net.ParseMAC(s)
+	case kindString:
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown field kind %d", kind)
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenOperator
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func isOperatorChar(r rune) bool {
+	return r == '=' || r == '!' || r == '<' || r == '>'
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[i+1 : end])})
+			i = end + 1
+		case isOperatorChar(r):
+			end := i
+			for end < len(runes) && isOperatorChar(runes[end]) {
+				end++
+			}
+			op := string(runes[i:end])
+			if op == "=" {
+				op = "=="
+			}
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=":
+			default:
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, token{tokenOperator, op})
+			i = end
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !isOperatorChar(runes[end]) &&
+				runes[end] != '(' && runes[end] != ')' && runes[end] != '"' {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *parser) next() *token {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t != nil && t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) parseOr() (Filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.next()
+		g, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		f = orFilter{f, g}
+	}
+	return f, nil
+}
+
+func (p *parser) parseAnd() (Filter, error) {
+	f, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.next()
+		g, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		f = andFilter{f, g}
+	}
+	return f, nil
+}
+
+func (p *parser) parseNot() (Filter, error) {
+	if p.peekKeyword("not") {
+		p.next()
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{f}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Filter, error) {
+	t := p.next()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	if t.kind == tokenOpen {
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t == nil || t.kind != tokenClose {
+			return nil, fmt.Errorf("missing )")
+		}
+		return f, nil
+	}
+	if t.kind != tokenWord {
+		return nil, fmt.Errorf("expected a field name, got %q", t.text)
+	}
+	name := strings.ToLower(t.text)
+	f, ok := fields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", t.text)
+	}
+
+	t = p.next()
+	if t == nil {
+		return nil, fmt.Errorf("expected an operator after %s", name)
+	}
+	var op string
+	if t.kind == tokenOperator {
+		op = t.text
+	} else if t.kind == tokenWord && strings.EqualFold(t.text, "in") {
+		op = "in"
+	} else {
+		return nil, fmt.Errorf("expected an operator after %s, got %q", name, t.text)
+	}
+
+	t = p.next()
+	if t == nil || t.kind != tokenWord {
+		return nil, fmt.Errorf("expected a value after %s %s", name, op)
+	}
+	value, err := parseValue(f.kind, op, t.text)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", name, op, err)
+	}
+	return &comparison{name: name, field: f, op: op, value: value}, nil
+}
+
+// ParseFilter parses a filter expression such as
+//
+//	dst_port == 443 and (src_ip in 10.0.0.0/8 or not layer2_type == IPv6)
+//
+// An empty expression matches every packet.
+func ParseFilter(s string) (Filter, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return allFilter{}, nil
+	}
+	p := &parser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	return f, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+	"github.com/interarticle/bandwidth_recorder/recording"
+)
+
+// repairMain implements
+//
+//	bandwidth_stats repair --recording=damaged.gob --output=repaired.gob
+//
+// which rewrites the intact records of a damaged gob recording to a clean
+// one.
+func repairMain(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	input := flags.String("recording", "", "Path to the damaged gob recording, optionally gzipped.")
+	output := flags.String("output", "", "Path of the repaired recording.")
+	format := flags.String("format", recording.FormatGob, "Format of the repaired recording: gob or columnar.")
+	compress := flags.Bool("compress", false, "Whether to compress the repaired recording.")
+	indexInterval := flags.Duration("index_interval", time.Minute, "Granularity of the index written alongside a repaired gob recording; 0 disables the index.")
+	flags.Parse(args)
+	if *input == "" || *output == "" {
+		log.Fatal("you must specify --recording and --output")
+	}
+
+	srcFile, closer, isColumnar, err := openRecording(*input, time.Time{}, time.Time{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closer.Close()
+	if isColumnar {
+		log.Fatal("only gob recordings can be repaired")
+	}
+	w, err := recording.Create(*output, recording.Config{
+		Format:        *format,
+		Compress:      *compress,
+		IndexInterval: *indexInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// A single reader keeps the records in order.
+	mapper := NewGobMapper(srcFile)
+	reader := mapper.RegisterReader()
+	done := make(chan struct{})
+	var writeErr error
+	written := 0
+	go func() {
+		defer close(done)
+		mapper.Decode(reader, func(m *data.PacketMetadata) {
+			if writeErr == nil {
+				writeErr = w.Write(m)
+				written++
+			}
+		})
+	}()
+	mapper.Start()
+	<-done
+	mapper.Report()
+
+	err = w.Close()
+	if writeErr != nil {
+		err = writeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d records to %s", written, *output)
+}
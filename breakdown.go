@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/classify"
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+)
+
+const (
+	directionTx      = "tx"
+	directionRx      = "rx"
+	directionUnknown = "unknown"
+)
+
+// services classifies traffic for the per-service counters; it is replaced
+// in main if services are configured.
+var services, _ = classify.NewClassifier(classify.DefaultServices)
+
+// protocolBreakdown accumulates traffic of an interface per transport
+// protocol and service between flushes.
+type protocolBreakdown struct {
+	iface                           string
+	protocolCounter, serviceCounter *persistmetric.Counter
+
+	protocols, services labeledDeltas
+}
+
+func (b *protocolBreakdown) observe(transport gopacket.Layer, direction string, size uint64) {
+	protocol, srcPort, dstPort := classify.Transport(transport)
+	b.protocols.add(size, b.iface, protocol, direction)
+	b.services.add(size, b.iface, services.Service(protocol, srcPort, dstPort), direction)
+}
+
+func (b *protocolBreakdown) flush(now time.Time) {
+	b.protocols.flush(b.protocolCounter, now)
+	b.services.flush(b.serviceCounter, now)
+}
+
+var (
+	l4ProtocolBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "l4_protocol_bytes",
+		Help: "Number of bytes transmitted on the Internet interface on Layer 4 by transport protocol",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "protocol", "direction"}))
+	l4ServiceBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "l4_service_bytes",
+		Help: "Number of bytes transmitted on the Internet interface on Layer 4 by service",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "service", "direction"}))
+	lanL4ProtocolBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "lan_l4_protocol_bytes",
+		Help: "Number of bytes sent/received on the LAN interface by transport protocol",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "protocol", "direction"}))
+	lanL4ServiceBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "lan_l4_service_bytes",
+		Help: "Number of bytes sent/received on the LAN interface by service",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "service", "direction"}))
+)
+
+func init() {
+	prometheus.MustRegister(l4ProtocolBytesCounter)
+	prometheus.MustRegister(l4ServiceBytesCounter)
+}
+
+func initLanBreakdown() {
+	prometheus.MustRegister(lanL4ProtocolBytesCounter)
+	prometheus.MustRegister(lanL4ServiceBytesCounter)
+}
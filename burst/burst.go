@@ -0,0 +1,428 @@
+// Package burst computes 95th percentile, or burstable, billing of an
+// uplink: throughput is sampled at fixed intervals over each billing cycle,
+// and the cycle is billed at a percentile of the samples, disregarding the
+// highest.
+package burst
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+const (
+	// Bucket of the persistent storage holding a record of each sample,
+	// keyed by the since label of its cycle, the separator and its start.
+	// Saving a sample thus does not rewrite its whole cycle.
+	samplesBucket   = "burst-samples"
+	sampleSeparator = "::"
+
+	directionTx = "tx"
+	directionRx = "rx"
+)
+
+// Mode is how the throughput of both directions is combined.
+type Mode string
+
+const (
+	// ModeMax bills the higher of the percentiles of each direction.
+	ModeMax Mode = "max"
+	// ModeSum bills the percentile of the sum of both directions.
+	ModeSum Mode = "sum"
+)
+
+// ParseMode parses a Mode by name.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeMax, ModeSum:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown burst billing mode %q", s)
+}
+
+// Config describes how an uplink is billed.
+type Config struct {
+	// Window is the billing cycle.
+	Window *window.Window
+	Mode   Mode
+	// SampleInterval defaults to 5 minutes, and Percentile to 95.
+	SampleInterval time.Duration
+	Percentile     float64
+}
+
+// Sample holds the number of bytes transmitted in each direction during one
+// sample interval.
+type Sample struct {
+	Start   time.Time
+	TxBytes uint64
+	RxBytes uint64
+}
+
+// Result is the billed throughput of a cycle, in bytes per second.
+type Result struct {
+	Since   string
+	Samples int
+	TxRate  float64
+	RxRate  float64
+	Billed  float64
+}
+
+// percentile returns the p-th percentile of values, sorting them: the
+// highest value once the top 100-p percent of values are discarded.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	i := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return values[i]
+}
+
+// Compute computes the billed throughput of the samples of a cycle.
+func Compute(since string, samples []Sample, interval time.Duration, mode Mode, p float64) Result {
+	seconds := interval.Seconds()
+	var tx, rx, sum []float64
+	for _, sample := range samples {
+		tx = append(tx, float64(sample.TxBytes)/seconds)
+		rx = append(rx, float64(sample.RxBytes)/seconds)
+		sum = append(sum, float64(sample.TxBytes+sample.RxBytes)/seconds)
+	}
+	result := Result{
+		Since:   since,
+		Samples: len(samples),
+		TxRate:  percentile(tx, p),
+		RxRate:  percentile(rx, p),
+	}
+	switch mode {
+	case ModeSum:
+		result.Billed = percentile(sum, p)
+	default:
+		result.Billed = math.Max(result.TxRate, result.RxRate)
+	}
+	return result
+}
+
+// samplesToValues converts samples to persisted values, one per direction.
+func samplesToValues(samples []Sample, windowName string) persistmetric.MetricValues {
+	var values persistmetric.MetricValues
+	for _, sample := range samples {
+		since := sample.Start.Format(time.RFC3339)
+		values = append(values,
+			persistmetric.MetricValue{Since: since, Window: windowName, Value: float64(sample.TxBytes), Labels: []string{directionTx}},
+			persistmetric.MetricValue{Since: since, Window: windowName, Value: float64(sample.RxBytes), Labels: []string{directionRx}})
+	}
+	return values
+}
+
+func valuesToSamples(values persistmetric.MetricValues) ([]Sample, error) {
+	bySince := make(map[string]*Sample)
+	var samples []*Sample
+	for _, value := range values {
+		sample, ok := bySince[value.Since]
+		if !ok {
+			start, err := time.Parse(time.RFC3339, value.Since)
+			if err != nil {
+				return nil, err
+			}
+			sample = &Sample{Start: start}
+			bySince[value.Since] = sample
+			samples = append(samples, sample)
+		}
+		if len(value.Labels) != 1 {
+			return nil, fmt.Errorf("invalid labels %v of sample %s", value.Labels, value.Since)
+		}
+		// Samples of the same interval are saved more than once if the
+		// recorder restarted during it.
+		switch value.Labels[0] {
+		case directionTx:
+			sample.TxBytes += uint64(value.Value)
+		case directionRx:
+			sample.RxBytes += uint64(value.Value)
+		}
+	}
+	result := make([]Sample, len(samples))
+	for i, sample := range samples {
+		result[i] = *sample
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result, nil
+}
+
+// Cycle holds the samples of one billing cycle.
+type Cycle struct {
+	Since   string
+	Samples []Sample
+}
+
+// sampleKey returns the key of the record of the sample starting at start
+// of the cycle since.
+func sampleKey(since string, start time.Time) string {
+	return since + sampleSeparator + start.Format(time.RFC3339)
+}
+
+// keyCycle returns the since label of the cycle of a sample by its key.
+func keyCycle(key string) string {
+	if i := strings.Index(key, sampleSeparator); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// readCycleValues reads the saved values of the samples whose keys start
+// with prefix, by the since label of their cycle.
+func readCycleValues(s *persistmetric.Storage, prefix string) (map[string]persistmetric.MetricValues, error) {
+	records, err := s.ReadRecords(samplesBucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	cycles := make(map[string]persistmetric.MetricValues)
+	for key, values := range records {
+		cycle := keyCycle(key)
+		cycles[cycle] = append(cycles[cycle], values...)
+	}
+	return cycles, nil
+}
+
+// readCycle reads the samples of the cycle since.
+func readCycle(s *persistmetric.Storage, since string) ([]Sample, error) {
+	cycles, err := readCycleValues(s, since+sampleSeparator)
+	if err != nil {
+		return nil, err
+	}
+	return valuesToSamples(cycles[since])
+}
+
+// ReadCycles reads the samples of all cycles recorded in s, ordered by the
+// since label of the cycle.
+func ReadCycles(s *persistmetric.Storage) ([]Cycle, error) {
+	values, err := readCycleValues(s, "")
+	if err != nil {
+		return nil, err
+	}
+	var cycles []Cycle
+	for since, cycleValues := range values {
+		samples, err := valuesToSamples(cycleValues)
+		if err != nil {
+			return nil, fmt.Errorf("cycle %s: %v", since, err)
+		}
+		cycles = append(cycles, Cycle{Since: since, Samples: samples})
+	}
+	sort.Slice(cycles, func(i, j int) bool {
+		return cycles[i].Since < cycles[j].Since
+	})
+	return cycles, nil
+}
+
+// Billing samples the throughput of an uplink, persisting the samples of
+// each cycle, and exports the billed throughput of the current cycle as
+// Prometheus gauges.
+type Billing struct {
+	s      *persistmetric.Storage
+	config Config
+
+	mu      sync.Mutex
+	since   string
+	samples []Sample
+	current *Sample
+
+	billedDesc  *prometheus.Desc
+	rateDesc    *prometheus.Desc
+	samplesDesc *prometheus.Desc
+}
+
+// New creates a Billing which records samples in s. Samples of past cycles
+// are deleted once the retention policy of s would expire periods of the
+// billing window, and kept forever without one.
+func New(s *persistmetric.Storage, config Config) (*Billing, error) {
+	if config.Window == nil {
+		return nil, errors.New("burst billing needs a window")
+	}
+	if config.Mode == "" {
+		config.Mode = ModeMax
+	}
+	if config.SampleInterval == 0 {
+		config.SampleInterval = 5 * time.Minute
+	}
+	if config.Percentile == 0 {
+		config.Percentile = 95
+	}
+	if config.Percentile < 0 || config.Percentile > 100 {
+		return nil, fmt.Errorf("invalid percentile %v", config.Percentile)
+	}
+	return &Billing{
+		s:      s,
+		config: config,
+		billedDesc: prometheus.NewDesc("burst_billed_rate_bytes_per_second",
+			"Billed throughput of the current burstable billing cycle so far",
+			[]string{"since", "mode"}, nil),
+		rateDesc: prometheus.NewDesc("burst_percentile_rate_bytes_per_second",
+			"Percentile of the sampled throughput of each direction in the current burstable billing cycle",
+			[]string{"since", "direction"}, nil),
+		samplesDesc: prometheus.NewDesc("burst_samples",
+			"Number of throughput samples taken in the current burstable billing cycle",
+			[]string{"since"}, nil),
+	}, nil
+}
+
+// Load reads the samples of the current cycle at now. The storage must
+// already be initialized.
+func (b *Billing) Load(now time.Time) error {
+	err := b.prune(now)
+	if err != nil {
+		return err
+	}
+	since := b.config.Window.Since(now)
+	samples, err := readCycle(b.s, since)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.since = since
+	b.samples = samples
+	return nil
+}
+
+// Add accounts bytes transmitted in each direction at now. Once now is past
+// the interval of the current sample, that sample is saved.
+func (b *Billing) Add(now time.Time, txBytes, rxBytes uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	start := now.Truncate(b.config.SampleInterval)
+	var err error
+	if b.current != nil && !b.current.Start.Equal(start) {
+		err = b.finishSample()
+	}
+	if b.current == nil {
+		b.current = &Sample{Start: start}
+	}
+	b.current.TxBytes += txBytes
+	b.current.RxBytes += rxBytes
+	return err
+}
+
+// Flush saves the current, incomplete sample, as at the end of a replay.
+func (b *Billing) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil {
+		return nil
+	}
+	return b.finishSample()
+}
+
+// finishSample adds the current sample to its cycle, and saves it.
+func (b *Billing) finishSample() error {
+	sample := *b.current
+	b.current = nil
+	since := b.config.Window.Since(sample.Start)
+	if since != b.since {
+		err := b.prune(sample.Start)
+		if err != nil {
+			return err
+		}
+		samples, err := readCycle(b.s, since)
+		if err != nil {
+			return err
+		}
+		b.samples = samples
+		b.since = since
+	}
+
+	// Part of the sample is already saved if the recorder restarted or was
+	// flushed during its interval.
+	key := sampleKey(since, sample.Start)
+	records, err := b.s.ReadRecords(samplesBucket, key)
+	if err != nil {
+		return err
+	}
+	saved := records[key]
+	merged, err := valuesToSamples(append(saved, samplesToValues([]Sample{sample}, b.config.Window.Name())...))
+	if err != nil {
+		return err
+	}
+	err = b.s.WriteRecord(samplesBucket, key, samplesToValues(merged, b.config.Window.Name()))
+	if err != nil {
+		return err
+	}
+
+	if n := len(b.samples); n > 0 && b.samples[n-1].Start.Equal(sample.Start) {
+		b.samples[n-1].TxBytes += sample.TxBytes
+		b.samples[n-1].RxBytes += sample.RxBytes
+	} else {
+		b.samples = append(b.samples, sample)
+	}
+	return nil
+}
+
+// prune deletes the samples of cycles which ended longer ago as of now than
+// the retention policy of the storage keeps periods of the billing window.
+func (b *Billing) prune(now time.Time) error {
+	keep := b.s.RetentionKeep(b.config.Window.Name())
+	if keep == 0 {
+		return nil
+	}
+	keys, err := b.s.ListRecords(samplesBucket)
+	if err != nil {
+		return err
+	}
+	pruned := make(map[string]bool)
+	for _, key := range keys {
+		cycle := keyCycle(key)
+		if pruned[cycle] {
+			continue
+		}
+		start, err := b.config.Window.ParseSince(cycle)
+		if err != nil {
+			continue // Samples of another billing window.
+		}
+		_, end := b.config.Window.Bounds(start)
+		if now.Sub(end) < keep {
+			continue
+		}
+		err = b.s.DeleteRecords(samplesBucket, cycle+sampleSeparator)
+		if err != nil {
+			return err
+		}
+		pruned[cycle] = true
+	}
+	return nil
+}
+
+// Result returns the billed throughput of the current cycle so far.
+func (b *Billing) Result() Result {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Compute(b.since, b.samples, b.config.SampleInterval, b.config.Mode, b.config.Percentile)
+}
+
+func (b *Billing) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.billedDesc
+	ch <- b.rateDesc
+	ch <- b.samplesDesc
+}
+
+func (b *Billing) Collect(ch chan<- prometheus.Metric) {
+	result := b.Result()
+	if result.Since == "" {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(b.billedDesc, prometheus.GaugeValue, result.Billed, result.Since, string(b.config.Mode))
+	ch <- prometheus.MustNewConstMetric(b.rateDesc, prometheus.GaugeValue, result.TxRate, result.Since, directionTx)
+	ch <- prometheus.MustNewConstMetric(b.rateDesc, prometheus.GaugeValue, result.RxRate, result.Since, directionRx)
+	ch <- prometheus.MustNewConstMetric(b.samplesDesc, prometheus.GaugeValue, float64(result.Samples), result.Since)
+}
@@ -0,0 +1,82 @@
+// burst_report prints the burstable billing of closed cycles from the
+// samples bandwidth_recorder saved with --burst_billing_window.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/burst"
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+var (
+	databasePath   = flag.String("database_path", "", "Path to the database of bandwidth_recorder. It can only be opened by one process at a time, so use a copy while the recorder is running.")
+	windowSpec     = flag.String("window", "month", "Billing cycle, as given to --burst_billing_window of the recorder.")
+	mode           = flag.String("mode", "max", "How directions are combined: max bills the higher of the percentiles of Tx and Rx, sum the percentile of their sum.")
+	percentile     = flag.Float64("percentile", 95, "Percentile of the samples billed.")
+	sampleInterval = flag.Duration("sample_interval", 5*time.Minute, "Interval of the samples, as given to --burst_billing_sample_interval of the recorder.")
+	includeCurrent = flag.Bool("include_current", false, "Whether to include the current, unfinished cycle.")
+)
+
+// formatMbps formats a rate in bytes per second as megabits per second.
+func formatMbps(rate float64) string {
+	return strconv.FormatFloat(rate*8/1e6, 'f', 3, 64)
+}
+
+func main() {
+	flag.Parse()
+	if *databasePath == "" {
+		log.Fatal("you must specify --database_path")
+	}
+	w, err := window.Parse(*windowSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	billingMode, err := burst.ParseMode(*mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := persistmetric.New(persistmetric.AutoSave(false, 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = storage.Initialize(context.Background(), *databasePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cycles, err := burst.ReadCycles(storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "cycle\tend\tsamples\ttx Mbit/s\trx Mbit/s\tbilled Mbit/s\t")
+	for _, cycle := range cycles {
+		start, err := w.ParseSince(cycle.Since)
+		if err != nil {
+			log.Printf("Skipping cycle %s of another window: %v", cycle.Since, err)
+			continue
+		}
+		_, end := w.Bounds(start)
+		if end.After(now) && !*includeCurrent {
+			continue
+		}
+		result := burst.Compute(cycle.Since, cycle.Samples, *sampleInterval, billingMode, *percentile)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t\n", cycle.Since, end.Format("2006-01-02 15:04"), result.Samples,
+			formatMbps(result.TxRate), formatMbps(result.RxRate), formatMbps(result.Billed))
+	}
+	err = tw.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+// Package classify names the transport protocol and service of packets, for
+// breaking traffic down by kind.
+package classify
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// OtherService is the service of packets matching no configured class.
+const OtherService = "other"
+
+// Transport returns the protocol name and ports of a transport layer, such
+// as "tcp" or "icmpv6". Ports are zero for protocols without them.
+func Transport(layer gopacket.Layer) (protocol string, srcPort, dstPort uint16) {
+	switch l := layer.(type) {
+	case *layers.TCP:
+		return "tcp", uint16(l.SrcPort), uint16(l.DstPort)
+	case *layers.UDP:
+		return "udp", uint16(l.SrcPort), uint16(l.DstPort)
+	case *layers.UDPLite:
+		return "udplite", uint16(l.SrcPort), uint16(l.DstPort)
+	case *layers.SCTP:
+		return "sctp", uint16(l.SrcPort), uint16(l.DstPort)
+	case *layers.ICMPv4:
+		return "icmp", 0, 0
+	case *layers.ICMPv6:
+		return "icmpv6", 0, 0
+	}
+	return strings.ToLower(layer.LayerType().String()), 0, 0
+}
+
+// ServiceConfig describes a class of traffic identified by port.
+type ServiceConfig struct {
+	Name string `json:"name"`
+	// Protocol is "tcp", "udp" or the like; empty matches any protocol with
+	// ports.
+	Protocol string `json:"protocol"`
+	// Ports are single ports ("443") or inclusive ranges ("27000-27100").
+	Ports []string `json:"ports"`
+}
+
+// DefaultServices are well-known services classified out of the box.
+var DefaultServices = []ServiceConfig{
+	{Name: "https", Protocol: "tcp", Ports: []string{"443"}},
+	{Name: "quic", Protocol: "udp", Ports: []string{"443"}},
+	{Name: "http", Protocol: "tcp", Ports: []string{"80", "8080"}},
+	{Name: "dns", Ports: []string{"53"}},
+	{Name: "dns_over_tls", Protocol: "tcp", Ports: []string{"853"}},
+	{Name: "ssh", Protocol: "tcp", Ports: []string{"22"}},
+	{Name: "ntp", Protocol: "udp", Ports: []string{"123"}},
+	{Name: "mail", Protocol: "tcp", Ports: []string{"25", "465", "587", "993", "995"}},
+	{Name: "vpn", Protocol: "udp", Ports: []string{"500", "1194", "4500", "51820"}},
+	{Name: "rtmp", Protocol: "tcp", Ports: []string{"1935"}},
+	{Name: "game", Protocol: "udp", Ports: []string{"3074", "3478-3480", "27000-27100"}},
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+type service struct {
+	name     string
+	protocol string
+	ports    []portRange
+}
+
+func (s *service) matches(protocol string, port uint16) bool {
+	if s.protocol != "" && s.protocol != protocol {
+		return false
+	}
+	for _, r := range s.ports {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Classifier assigns packets to services by port.
+type Classifier struct {
+	services []service
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	return uint16(port), err
+}
+
+// NewClassifier creates a classifier for the given services. Earlier
+// services take precedence over later ones.
+func NewClassifier(configs []ServiceConfig) (*Classifier, error) {
+	c := &Classifier{}
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("service must have a name")
+		}
+		s := service{
+			name:     config.Name,
+			protocol: strings.ToLower(config.Protocol),
+		}
+		for _, spec := range config.Ports {
+			bounds := strings.SplitN(spec, "-", 2)
+			lo, err := parsePort(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("service %s: invalid port %q", config.Name, spec)
+			}
+			hi := lo
+			if len(bounds) == 2 {
+				hi, err = parsePort(bounds[1])
+				if err != nil || hi < lo {
+					return nil, fmt.Errorf("service %s: invalid port range %q", config.Name, spec)
+				}
+			}
+			s.ports = append(s.ports, portRange{lo: lo, hi: hi})
+		}
+		c.services = append(c.services, s)
+	}
+	return c, nil
+}
+
+// Service returns the name of the service of a packet, or OtherService.
+// Destination ports are matched before source ports, so that both
+// directions of a connection get the server's service.
+func (c *Classifier) Service(protocol string, srcPort, dstPort uint16) string {
+	if srcPort == 0 && dstPort == 0 {
+		return OtherService
+	}
+	for _, port := range []uint16{dstPort, srcPort} {
+		for i := range c.services {
+			if c.services[i].matches(protocol, port) {
+				return c.services[i].name
+			}
+		}
+	}
+	return OtherService
+}
@@ -0,0 +1,218 @@
+// Package columnar implements a chunked columnar file format for packet
+// metadata, which is much faster to scan than a gob stream.
+//
+// A file starts with Magic and is followed by chunks of up to a configured
+// number of packets. Each chunk is
+//
+//	"CHNK" | Stats | uint32 body length | body
+//
+// with Stats in fixed size big endian form, so that readers can skip chunks
+// that cannot match a query without decoding them. The body, optionally
+// compressed with flate, holds one column per PacketMetadata field, each
+// prefixed with its length as a uvarint. Capture times are delta encoded
+// varints, MAC and IP addresses are indexes into a per-column dictionary,
+// and the remaining fields are uvarints.
+package columnar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// Magic starts every columnar file.
+	Magic = "BWRCOL1\n"
+
+	chunkMagic = "CHNK"
+
+	flagCompressed = 1 << 0
+)
+
+// Stats summarizes a chunk. Addresses are in 16 byte form; if a chunk has
+// no IP addresses in a column, its minimum is greater than its maximum.
+type Stats struct {
+	Rows  uint32
+	Flags uint32
+
+	MinTime, MaxTime           int64
+	MinTotalSize, MaxTotalSize uint32
+	MinSrcPort, MaxSrcPort     uint16
+	MinDstPort, MaxDstPort     uint16
+	MinSrcIP, MaxSrcIP         [16]byte
+	MinDstIP, MaxDstIP         [16]byte
+}
+
+var statsSize = binary.Size(Stats{})
+
+func (s *Stats) TimeRange() (min, max time.Time) {
+	return time.Unix(0, s.MinTime), time.Unix(0, s.MaxTime)
+}
+
+func ip16(ip net.IP) (b [16]byte) {
+	copy(b[:], ip.To16())
+	return b
+}
+
+// ipRangeOverlaps reports whether any address within [min, max] may lie in
+// [first, last].
+func ipRangeOverlaps(min, max, first, last [16]byte) bool {
+	if bytes.Compare(min[:], max[:]) > 0 {
+		return false
+	}
+	return bytes.Compare(min[:], last[:]) <= 0 && bytes.Compare(first[:], max[:]) <= 0
+}
+
+func networkRange(network *net.IPNet) (first, last [16]byte) {
+	ip := network.IP.Mask(network.Mask)
+	mask := network.Mask
+	if len(ip) == net.IPv4len {
+		ip = ip.To16()
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range first {
+		first[i] = ip[i]
+		last[i] = ip[i] | ^mask[i]
+	}
+	return first, last
+}
+
+// SrcIPMayBeIn reports whether some source address of the chunk may be
+// within network.
+func (s *Stats) SrcIPMayBeIn(network *net.IPNet) bool {
+	first, last := networkRange(network)
+	return ipRangeOverlaps(s.MinSrcIP, s.MaxSrcIP, first, last)
+}
+
+// DstIPMayBeIn is SrcIPMayBeIn for destination addresses.
+func (s *Stats) DstIPMayBeIn(network *net.IPNet) bool {
+	first, last := networkRange(network)
+	return ipRangeOverlaps(s.MinDstIP, s.MaxDstIP, first, last)
+}
+
+// columnReader decodes the values of a column.
+type columnReader struct {
+	name string
+	b    []byte
+	err  error
+}
+
+func (c *columnReader) uvarint() uint64 {
+	if c.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(c.b)
+	if n <= 0 {
+		c.err = fmt.Errorf("column %s is truncated", c.name)
+		return 0
+	}
+	c.b = c.b[n:]
+	return v
+}
+
+func (c *columnReader) varint() int64 {
+	if c.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(c.b)
+	if n <= 0 {
+		c.err = fmt.Errorf("column %s is truncated", c.name)
+		return 0
+	}
+	c.b = c.b[n:]
+	return v
+}
+
+func (c *columnReader) bytes(n uint64) []byte {
+	if c.err != nil {
+		return nil
+	}
+	if uint64(len(c.b)) < n {
+		c.err = fmt.Errorf("column %s is truncated", c.name)
+		return nil
+	}
+	b := c.b[:n:n]
+	c.b = c.b[n:]
+	return b
+}
+
+// dictionary reads the dictionary at the start of an address column.
+func (c *columnReader) dictionary() [][]byte {
+	size := c.uvarint()
+	if c.err != nil || size > uint64(len(c.b)) {
+		c.err = fmt.Errorf("column %s has an invalid dictionary", c.name)
+		return nil
+	}
+	entries := make([][]byte, size)
+	for i := range entries {
+		entries[i] = c.bytes(c.uvarint())
+	}
+	return entries
+}
+
+// lookup reads the next dictionary index, where 0 stands for no address.
+func (c *columnReader) lookup(entries [][]byte) []byte {
+	i := c.uvarint()
+	if i == 0 || c.err != nil {
+		return nil
+	}
+	if i > uint64(len(entries)) {
+		c.err = fmt.Errorf("column %s refers to missing dictionary entry %d", c.name, i)
+		return nil
+	}
+	return entries[i-1]
+}
+
+// columnWriter encodes the values of a column.
+type columnWriter struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (c *columnWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(c.scratch[:], v)
+	c.Write(c.scratch[:n])
+}
+
+func (c *columnWriter) putVarint(v int64) {
+	n := binary.PutVarint(c.scratch[:], v)
+	c.Write(c.scratch[:n])
+}
+
+// dictionaryColumn encodes byte strings as indexes into a dictionary.
+type dictionaryColumn struct {
+	indexes map[string]uint64
+	entries [][]byte
+	values  columnWriter
+}
+
+func newDictionaryColumn() *dictionaryColumn {
+	return &dictionaryColumn{indexes: make(map[string]uint64)}
+}
+
+func (d *dictionaryColumn) put(b []byte) {
+	if b == nil {
+		d.values.putUvarint(0)
+		return
+	}
+	i, ok := d.indexes[string(b)]
+	if !ok {
+		d.entries = append(d.entries, b)
+		i = uint64(len(d.entries))
+		d.indexes[string(b)] = i
+	}
+	d.values.putUvarint(i)
+}
+
+func (d *dictionaryColumn) encode() []byte {
+	var c columnWriter
+	c.putUvarint(uint64(len(d.entries)))
+	for _, entry := range d.entries {
+		c.putUvarint(uint64(len(entry)))
+		c.Write(entry)
+	}
+	c.Write(d.values.Bytes())
+	return c.Bytes()
+}
@@ -0,0 +1,156 @@
+package columnar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// IsColumnar reports whether header, the first bytes of a file, is that of
+// a columnar file.
+func IsColumnar(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(Magic))
+}
+
+// Chunk is a chunk read from a file, yet to be decoded.
+type Chunk struct {
+	Stats Stats
+	body  []byte
+}
+
+// Decode decodes the packets of the chunk. It may be called concurrently
+// with reading further chunks.
+func (c *Chunk) Decode() ([]data.PacketMetadata, error) {
+	body := c.body
+	if c.Stats.Flags&flagCompressed != 0 {
+		var err error
+		body, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := []string{
+		"capture_time", "total_size",
+		"layer1_type", "layer2_type", "layer3_type",
+		"layer1_size", "layer2_size", "layer3_size",
+		"src_mac", "dst_mac", "src_ip", "dst_ip",
+		"src_port", "dst_port",
+	}
+	columns := make([]*columnReader, len(names))
+	bodyReader := &columnReader{name: "body", b: body}
+	for i, name := range names {
+		columns[i] = &columnReader{name: name, b: bodyReader.bytes(bodyReader.uvarint())}
+	}
+	if bodyReader.err != nil {
+		return nil, bodyReader.err
+	}
+	captureTime, totalSize := columns[0], columns[1]
+	layerTypes, layerSizes := columns[2:5], columns[5:8]
+	srcMAC, dstMAC, srcIP, dstIP := columns[8], columns[9], columns[10], columns[11]
+	srcPort, dstPort := columns[12], columns[13]
+	srcMACs, dstMACs := srcMAC.dictionary(), dstMAC.dictionary()
+	srcIPs, dstIPs := srcIP.dictionary(), dstIP.dictionary()
+
+	rows := make([]data.PacketMetadata, c.Stats.Rows)
+	var t int64
+	for i := range rows {
+		m := &rows[i]
+		t += captureTime.varint()
+		m.CaptureTime = time.Unix(0, t)
+		m.TotalSize = int(totalSize.uvarint())
+		m.Layer1Type = gopacket.LayerType(layerTypes[0].uvarint())
+		m.Layer2Type = gopacket.LayerType(layerTypes[1].uvarint())
+		m.Layer3Type = gopacket.LayerType(layerTypes[2].uvarint())
+		m.Layer1Size = int(layerSizes[0].uvarint())
+		m.Layer2Size = int(layerSizes[1].uvarint())
+		m.Layer3Size = int(layerSizes[2].uvarint())
+		m.SrcMAC = net.HardwareAddr(srcMAC.lookup(srcMACs))
+		m.DstMAC = net.HardwareAddr(dstMAC.lookup(dstMACs))
+		m.SrcIP = net.IP(srcIP.lookup(srcIPs))
+		m.DstIP = net.IP(dstIP.lookup(dstIPs))
+		m.SrcPort = uint16(srcPort.uvarint())
+		m.DstPort = uint16(dstPort.uvarint())
+	}
+	for _, column := range columns {
+		if column.err != nil {
+			return nil, column.err
+		}
+	}
+	return rows, nil
+}
+
+// Reader reads the chunks of a columnar file.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader checks the magic at the start of r.
+func NewReader(r io.Reader) (*Reader, error) {
+	magic := make([]byte, len(Magic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	if !IsColumnar(magic) {
+		return nil, fmt.Errorf("not a columnar file")
+	}
+	return &Reader{r: r}, nil
+}
+
+// Next returns the next chunk for which mayMatch, if not nil, is true,
+// skipping the bodies of others unread. It returns io.EOF at the end of the
+// file.
+func (r *Reader) Next(mayMatch func(stats *Stats) bool) (*Chunk, error) {
+	header := make([]byte, len(chunkMagic)+statsSize+4)
+	for {
+		_, err := io.ReadFull(r.r, header)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// The last chunk of a file being written.
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if string(header[:len(chunkMagic)]) != chunkMagic {
+			return nil, fmt.Errorf("invalid chunk header")
+		}
+		chunk := &Chunk{}
+		err = binary.Read(bytes.NewReader(header[len(chunkMagic):]), binary.BigEndian, &chunk.Stats)
+		if err != nil {
+			return nil, err
+		}
+		bodySize := int64(binary.BigEndian.Uint32(header[len(header)-4:]))
+
+		if mayMatch != nil && !mayMatch(&chunk.Stats) {
+			if seeker, ok := r.r.(io.Seeker); ok {
+				_, err = seeker.Seek(bodySize, io.SeekCurrent)
+			} else {
+				_, err = io.CopyN(ioutil.Discard, r.r, bodySize)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		chunk.body = make([]byte, bodySize)
+		_, err = io.ReadFull(r.r, chunk.body)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		return chunk, nil
+	}
+}
@@ -0,0 +1,211 @@
+package columnar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// DefaultChunkRows is the number of packets per chunk if not configured.
+const DefaultChunkRows = 65536
+
+type Options struct {
+	// ChunkRows is the maximum number of packets per chunk.
+	ChunkRows int
+	// Compress compresses each chunk body with flate.
+	Compress bool
+}
+
+// Writer writes a columnar file. It is not safe for concurrent use.
+type Writer struct {
+	w       io.Writer
+	options Options
+	rows    []data.PacketMetadata
+	written int64
+}
+
+func NewWriter(w io.Writer, options Options) (*Writer, error) {
+	if options.ChunkRows <= 0 {
+		options.ChunkRows = DefaultChunkRows
+	}
+	n, err := io.WriteString(w, Magic)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, options: options, written: int64(n)}, nil
+}
+
+func (w *Writer) Write(m *data.PacketMetadata) error {
+	w.rows = append(w.rows, *m)
+	if len(w.rows) >= w.options.ChunkRows {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Buffered returns the number of packets not yet written out in a chunk.
+func (w *Writer) Buffered() int {
+	return len(w.rows)
+}
+
+// Size returns the number of bytes written, estimating those of packets
+// not yet written out in a chunk.
+func (w *Writer) Size() int64 {
+	// Packets rarely take more than this once encoded.
+	const estimatedRowSize = 16
+	return w.written + int64(len(w.rows))*estimatedRowSize
+}
+
+func computeStats(rows []data.PacketMetadata) *Stats {
+	s := &Stats{
+		Rows:         uint32(len(rows)),
+		MinTime:      math.MaxInt64,
+		MinTotalSize: math.MaxUint32,
+		MinSrcPort:   math.MaxUint16,
+		MinDstPort:   math.MaxUint16,
+	}
+	for i := range s.MinSrcIP {
+		s.MinSrcIP[i], s.MinDstIP[i] = 0xff, 0xff
+	}
+	for i := range rows {
+		m := &rows[i]
+		t := m.CaptureTime.UnixNano()
+		if t < s.MinTime {
+			s.MinTime = t
+		}
+		if t > s.MaxTime {
+			s.MaxTime = t
+		}
+		size := uint32(m.TotalSize)
+		if size < s.MinTotalSize {
+			s.MinTotalSize = size
+		}
+		if size > s.MaxTotalSize {
+			s.MaxTotalSize = size
+		}
+		if m.SrcPort < s.MinSrcPort {
+			s.MinSrcPort = m.SrcPort
+		}
+		if m.SrcPort > s.MaxSrcPort {
+			s.MaxSrcPort = m.SrcPort
+		}
+		if m.DstPort < s.MinDstPort {
+			s.MinDstPort = m.DstPort
+		}
+		if m.DstPort > s.MaxDstPort {
+			s.MaxDstPort = m.DstPort
+		}
+		if m.SrcIP != nil {
+			ip := ip16(m.SrcIP)
+			if bytes.Compare(ip[:], s.MinSrcIP[:]) < 0 {
+				s.MinSrcIP = ip
+			}
+			if bytes.Compare(ip[:], s.MaxSrcIP[:]) > 0 {
+				s.MaxSrcIP = ip
+			}
+		}
+		if m.DstIP != nil {
+			ip := ip16(m.DstIP)
+			if bytes.Compare(ip[:], s.MinDstIP[:]) < 0 {
+				s.MinDstIP = ip
+			}
+			if bytes.Compare(ip[:], s.MaxDstIP[:]) > 0 {
+				s.MaxDstIP = ip
+			}
+		}
+	}
+	return s
+}
+
+func encodeBody(rows []data.PacketMetadata) []byte {
+	var captureTime, totalSize columnWriter
+	var layerTypes, layerSizes [3]columnWriter
+	var srcPort, dstPort columnWriter
+	srcMAC, dstMAC := newDictionaryColumn(), newDictionaryColumn()
+	srcIP, dstIP := newDictionaryColumn(), newDictionaryColumn()
+
+	var lastTime int64
+	for i := range rows {
+		m := &rows[i]
+		t := m.CaptureTime.UnixNano()
+		captureTime.putVarint(t - lastTime)
+		lastTime = t
+		totalSize.putUvarint(uint64(m.TotalSize))
+		layerTypes[0].putUvarint(uint64(m.Layer1Type))
+		layerTypes[1].putUvarint(uint64(m.Layer2Type))
+		layerTypes[2].putUvarint(uint64(m.Layer3Type))
+		layerSizes[0].putUvarint(uint64(m.Layer1Size))
+		layerSizes[1].putUvarint(uint64(m.Layer2Size))
+		layerSizes[2].putUvarint(uint64(m.Layer3Size))
+		srcMAC.put(m.SrcMAC)
+		dstMAC.put(m.DstMAC)
+		srcIP.put(m.SrcIP)
+		dstIP.put(m.DstIP)
+		srcPort.putUvarint(uint64(m.SrcPort))
+		dstPort.putUvarint(uint64(m.DstPort))
+	}
+
+	columns := [][]byte{
+		captureTime.Bytes(),
+		totalSize.Bytes(),
+		layerTypes[0].Bytes(), layerTypes[1].Bytes(), layerTypes[2].Bytes(),
+		layerSizes[0].Bytes(), layerSizes[1].Bytes(), layerSizes[2].Bytes(),
+		srcMAC.encode(), dstMAC.encode(),
+		srcIP.encode(), dstIP.encode(),
+		srcPort.Bytes(), dstPort.Bytes(),
+	}
+	var body columnWriter
+	for _, column := range columns {
+		body.putUvarint(uint64(len(column)))
+		body.Write(column)
+	}
+	return body.Bytes()
+}
+
+// Flush writes the buffered packets out as a chunk, even if it is not full.
+func (w *Writer) Flush() error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	stats := computeStats(w.rows)
+	body := encodeBody(w.rows)
+	if w.options.Compress {
+		stats.Flags |= flagCompressed
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(body)
+		if err != nil {
+			return err
+		}
+		err = fw.Close()
+		if err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+	}
+
+	var chunk bytes.Buffer
+	chunk.WriteString(chunkMagic)
+	binary.Write(&chunk, binary.BigEndian, stats)
+	binary.Write(&chunk, binary.BigEndian, uint32(len(body)))
+	chunk.Write(body)
+	n, err := w.w.Write(chunk.Bytes())
+	w.written += int64(n)
+	if err != nil {
+		return err
+	}
+	w.rows = w.rows[:0]
+	return nil
+}
+
+// Close flushes buffered packets; it does not close the underlying writer.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/interarticle/bandwidth_recorder/classify"
+	"github.com/interarticle/bandwidth_recorder/packetsource"
+	"github.com/interarticle/bandwidth_recorder/quota"
+)
+
+// recorderConfig holds the settings read from the JSON file given by
+// --config. Everything in it is optional.
+type recorderConfig struct {
+	Quotas       []quota.Config      `json:"quotas"`
+	DeviceGroups []deviceGroupConfig `json:"device_groups"`
+	DeviceNames  deviceNamesConfig   `json:"device_names"`
+	// WANSubnets are the local subnets WAN traffic is attributed to, in
+	// order of precedence.
+	WANSubnets []subnetConfig `json:"wan_subnets"`
+	// Services classify traffic by port, taking precedence over
+	// classify.DefaultServices.
+	Services []classify.ServiceConfig `json:"services"`
+	// Interfaces holds settings of monitored interfaces by their label.
+	Interfaces map[string]interfaceConfig `json:"interfaces"`
+}
+
+// interfaceConfig holds the settings of one monitored interface.
+type interfaceConfig struct {
+	// Direction selects how packets are classified as sent or received:
+	// "mac", the default, compares Ethernet addresses to that of the
+	// interface; "ip" compares IP addresses to those of the interface;
+	// "prefix" matches IP addresses against Prefixes; and "pcap" captures
+	// each direction separately, or uses the packet type of Linux cooked
+	// captures when replaying.
+	Direction string `json:"direction"`
+	// Prefixes are, on WAN interfaces, the local prefixes packets are sent
+	// from, and on LAN interfaces, the prefixes of the devices packets are
+	// sent to.
+	Prefixes []string `json:"prefixes"`
+	// Filter is a BPF filter expression selecting the packets accounted.
+	// It also applies when replaying captures.
+	Filter string `json:"filter"`
+	// Capture configures live captures on the interface. Busy Linux links
+	// can be read with {"backend": "afpacket", "fanout": 4}, which decodes
+	// packets in place on four sockets concurrently; that backend captures
+	// whole packets, so snaplen and promiscuous must then be unset.
+	Capture packetsource.CaptureOptions `json:"capture"`
+}
+
+// deviceNamesConfig selects where friendly names for LAN devices are read
+// from. Unset paths take the usual defaults, and missing files are ignored.
+type deviceNamesConfig struct {
+	DnsmasqLeases []string `json:"dnsmasq_leases"`
+	DHCPDLeases   []string `json:"dhcpd_leases"`
+	Ethers        string   `json:"ethers"`
+	ARPTable      string   `json:"arp_table"`
+	// VendorFile is an IEEE oui.txt or Wireshark manuf file.
+	VendorFile string `json:"vendor_file"`
+	// Static maps MAC addresses to names, overriding all other sources.
+	Static map[string]string `json:"static"`
+}
+
+// deviceGroupConfig groups LAN devices which share one allowance. A group
+// may also have no allowance, in which case it only appears in reports.
+type deviceGroupConfig struct {
+	Name           string   `json:"name"`
+	MACAddresses   []string `json:"mac_addresses"`
+	AllowanceBytes float64  `json:"allowance_bytes"`
+	// Window, Thresholds and Notify are as in quota.Config.
+	Window     string             `json:"window"`
+	Thresholds []float64          `json:"thresholds"`
+	Notify     []quota.SinkConfig `json:"notify"`
+}
+
+func loadConfig(path string) (*recorderConfig, error) {
+	config := &recorderConfig{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
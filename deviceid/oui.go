@@ -0,0 +1,47 @@
+package deviceid
+
+import (
+	"net"
+	"strings"
+)
+
+// LoadVendors reads a table of vendors by OUI (the first three bytes of a MAC
+// address). Both the IEEE oui.txt format ("00-00-0C   (hex)  Cisco") and the
+// Wireshark manuf format ("00:00:0C  Cisco  Cisco Systems, Inc") are
+// accepted; entries for longer prefixes are ignored.
+func LoadVendors(path string) (map[string]string, error) {
+	vendors := make(map[string]string)
+	err := readLines(path, func(fields []string) {
+		if len(fields) < 2 {
+			return
+		}
+		prefix := strings.Replace(strings.ToLower(fields[0]), "-", ":", -1)
+		if len(prefix) != len("00:00:0c") {
+			return
+		}
+		name := fields[1:]
+		if name[0] == "(hex)" {
+			name = name[1:]
+		} else if len(name) > 1 {
+			// The manuf format has a short name followed by the full
+			// name.
+			name = name[1:]
+		}
+		if len(name) == 0 {
+			return
+		}
+		vendors[prefix] = strings.Join(name, " ")
+	})
+	return vendors, err
+}
+
+// LookupVendor returns the vendor of mac in vendors, or "" if unknown.
+// Locally administered addresses, such as randomized ones used by phones for
+// privacy, never have a vendor.
+func LookupVendor(vendors map[string]string, mac string) string {
+	addr, err := net.ParseMAC(mac)
+	if err != nil || len(addr) < 3 || addr[0]&0x02 != 0 {
+		return ""
+	}
+	return vendors[addr[:3].String()]
+}
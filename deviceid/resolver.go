@@ -0,0 +1,149 @@
+// Package deviceid resolves LAN device MAC addresses to friendly names,
+// using DHCP leases, /etc/ethers, the kernel neighbor table and static
+// configuration.
+package deviceid
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Identity is what is known about the device with a MAC address.
+type Identity struct {
+	MAC      string
+	Hostname string
+	IP       string
+	Vendor   string
+}
+
+// Source reads device identities. Sources are consulted in the order given
+// to NewResolver; the first to provide a hostname or IP for a device wins.
+type Source interface {
+	Name() string
+	Read() ([]Identity, error)
+}
+
+type entry struct {
+	Identity
+	lastSeen time.Time
+}
+
+// Resolver periodically merges identities from its sources. Devices which
+// disappear from all sources, such as after a lease expires, are remembered
+// for a while so that they keep their names.
+type Resolver struct {
+	sources     []Source
+	vendors     map[string]string
+	forgetAfter time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]*entry
+
+	infoDesc *prometheus.Desc
+}
+
+func NewResolver(sources []Source, vendors map[string]string, forgetAfter time.Duration) *Resolver {
+	return &Resolver{
+		sources:     sources,
+		vendors:     vendors,
+		forgetAfter: forgetAfter,
+		entries:     make(map[string]*entry),
+		infoDesc: prometheus.NewDesc("lan_device_info",
+			"Identity of a LAN device; always 1. Join on mac_address to name per-device metrics.",
+			[]string{"mac_address", "hostname", "ip", "vendor"}, nil),
+	}
+}
+
+// normalizeMAC returns the canonical form of mac, as used in metric labels,
+// or "" if it is not a valid address.
+func normalizeMAC(mac string) string {
+	addr, err := net.ParseMAC(mac)
+	if err != nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// Refresh re-reads all sources. Sources which fail are logged and skipped.
+func (r *Resolver) Refresh(now time.Time) {
+	merged := make(map[string]*entry)
+	for _, source := range r.sources {
+		identities, err := source.Read()
+		if err != nil {
+			log.Printf("Warning: failed to read device identities from %s: %v", source.Name(), err)
+			continue
+		}
+		for _, identity := range identities {
+			mac := normalizeMAC(identity.MAC)
+			if mac == "" {
+				continue
+			}
+			e, ok := merged[mac]
+			if !ok {
+				e = &entry{Identity: Identity{MAC: mac}, lastSeen: now}
+				merged[mac] = e
+			}
+			if e.Hostname == "" {
+				e.Hostname = identity.Hostname
+			}
+			if e.IP == "" {
+				e.IP = identity.IP
+			}
+		}
+	}
+	for mac, e := range merged {
+		e.Vendor = LookupVendor(r.vendors, mac)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for mac, old := range r.entries {
+		if _, ok := merged[mac]; !ok && now.Sub(old.lastSeen) < r.forgetAfter {
+			merged[mac] = old
+		}
+	}
+	r.entries = merged
+}
+
+// Run refreshes the resolver every interval until stop is closed.
+func (r *Resolver) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.Refresh(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Lookup returns the identity of the device with the given MAC address.
+// Unknown devices have only MAC and Vendor set.
+func (r *Resolver) Lookup(mac string) Identity {
+	mac = normalizeMAC(mac)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e, ok := r.entries[mac]; ok {
+		return e.Identity
+	}
+	return Identity{MAC: mac, Vendor: LookupVendor(r.vendors, mac)}
+}
+
+func (r *Resolver) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.infoDesc
+}
+
+func (r *Resolver) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, e := range r.entries {
+		ch <- prometheus.MustNewConstMetric(r.infoDesc, prometheus.GaugeValue, 1,
+			e.MAC, e.Hostname, e.IP, e.Vendor)
+	}
+}
@@ -0,0 +1,204 @@
+package deviceid
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// readLines calls fn with the fields of each non-empty, non-comment line of
+// the file at path. A missing file yields no lines, as most of these files
+// only exist when the corresponding service is in use.
+func readLines(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			fn(fields)
+		}
+	}
+	return scanner.Err()
+}
+
+type dnsmasqLeases struct {
+	path string
+}
+
+// DnsmasqLeases reads a dnsmasq lease file, usually
+// /var/lib/misc/dnsmasq.leases.
+func DnsmasqLeases(path string) Source {
+	return &dnsmasqLeases{path: path}
+}
+
+func (s *dnsmasqLeases) Name() string {
+	return "dnsmasq leases " + s.path
+}
+
+func (s *dnsmasqLeases) Read() ([]Identity, error) {
+	var identities []Identity
+	err := readLines(s.path, func(fields []string) {
+		// <expiry> <mac> <ip> <hostname> <client id>; DHCPv6 leases
+		// have an IAID instead of a MAC and are skipped later.
+		if len(fields) < 4 {
+			return
+		}
+		identity := Identity{MAC: fields[1], IP: fields[2]}
+		if fields[3] != "*" {
+			identity.Hostname = fields[3]
+		}
+		identities = append(identities, identity)
+	})
+	return identities, err
+}
+
+type dhcpdLeases struct {
+	path string
+}
+
+// DHCPDLeases reads an ISC dhcpd lease database, usually
+// /var/lib/dhcp/dhcpd.leases. Only active leases are used.
+func DHCPDLeases(path string) Source {
+	return &dhcpdLeases{path: path}
+}
+
+func (s *dhcpdLeases) Name() string {
+	return "dhcpd leases " + s.path
+}
+
+func (s *dhcpdLeases) Read() ([]Identity, error) {
+	// The file is a journal; later lease declarations for an address
+	// replace earlier ones.
+	ipToIdentity := make(map[string]Identity)
+	var order []string
+	var current *Identity
+	active := true
+	err := readLines(s.path, func(fields []string) {
+		trim := func(s string) string {
+			return strings.Trim(strings.TrimSuffix(s, ";"), `"`)
+		}
+		switch {
+		case fields[0] == "lease" && len(fields) >= 2:
+			current = &Identity{IP: fields[1]}
+			active = true
+		case current == nil:
+		case fields[0] == "}":
+			if _, ok := ipToIdentity[current.IP]; !ok {
+				order = append(order, current.IP)
+			}
+			if active {
+				ipToIdentity[current.IP] = *current
+			} else {
+				delete(ipToIdentity, current.IP)
+			}
+			current = nil
+		case fields[0] == "hardware" && len(fields) >= 3:
+			current.MAC = trim(fields[2])
+		case fields[0] == "client-hostname" && len(fields) >= 2:
+			current.Hostname = trim(strings.Join(fields[1:], " "))
+		case fields[0] == "binding" && len(fields) >= 3 && fields[1] == "state":
+			active = trim(fields[2]) == "active"
+		}
+	})
+	var identities []Identity
+	for _, ip := range order {
+		if identity, ok := ipToIdentity[ip]; ok {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, err
+}
+
+type ethers struct {
+	path string
+}
+
+// Ethers reads an ethers(5) file, usually /etc/ethers, mapping MAC addresses
+// to hostnames or IP addresses.
+func Ethers(path string) Source {
+	return &ethers{path: path}
+}
+
+func (s *ethers) Name() string {
+	return "ethers " + s.path
+}
+
+func (s *ethers) Read() ([]Identity, error) {
+	var identities []Identity
+	err := readLines(s.path, func(fields []string) {
+		if len(fields) < 2 {
+			return
+		}
+		identity := Identity{MAC: fields[0]}
+		if net.ParseIP(fields[1]) != nil {
+			identity.IP = fields[1]
+		} else {
+			identity.Hostname = fields[1]
+		}
+		identities = append(identities, identity)
+	})
+	return identities, err
+}
+
+type arpTable struct {
+	path string
+}
+
+// ARPTable reads the kernel neighbor table in the format of /proc/net/arp.
+// It provides current IP addresses only.
+func ARPTable(path string) Source {
+	return &arpTable{path: path}
+}
+
+func (s *arpTable) Name() string {
+	return "ARP table " + s.path
+}
+
+func (s *arpTable) Read() ([]Identity, error) {
+	var identities []Identity
+	err := readLines(s.path, func(fields []string) {
+		// IP address, HW type, Flags, HW address, Mask, Device.
+		if len(fields) < 4 || fields[0] == "IP" {
+			return
+		}
+		// Flags of 0x0 mark incomplete entries.
+		if fields[2] == "0x0" || fields[3] == "00:00:00:00:00:00" {
+			return
+		}
+		identities = append(identities, Identity{MAC: fields[3], IP: fields[0]})
+	})
+	return identities, err
+}
+
+type static struct {
+	macToName map[string]string
+}
+
+// Static names devices from a fixed map of MAC address to hostname.
+func Static(macToName map[string]string) Source {
+	return &static{macToName: macToName}
+}
+
+func (s *static) Name() string {
+	return "static names"
+}
+
+func (s *static) Read() ([]Identity, error) {
+	var identities []Identity
+	for mac, name := range s.macToName {
+		identities = append(identities, Identity{MAC: mac, Hostname: name})
+	}
+	return identities, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/deviceid"
+	"github.com/interarticle/bandwidth_recorder/quota"
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+const deviceQuotaPrefix = "device:"
+
+func orDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// newDeviceResolver creates a resolver reading the sources in config.
+func newDeviceResolver(config deviceNamesConfig, forgetAfter time.Duration) (*deviceid.Resolver, error) {
+	var vendors map[string]string
+	if config.VendorFile != "" {
+		var err error
+		vendors, err = deviceid.LoadVendors(config.VendorFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sources := []deviceid.Source{deviceid.Static(config.Static)}
+	dnsmasqLeases := config.DnsmasqLeases
+	if dnsmasqLeases == nil {
+		dnsmasqLeases = []string{"/var/lib/misc/dnsmasq.leases"}
+	}
+	for _, path := range dnsmasqLeases {
+		sources = append(sources, deviceid.DnsmasqLeases(path))
+	}
+	dhcpdLeases := config.DHCPDLeases
+	if dhcpdLeases == nil {
+		dhcpdLeases = []string{"/var/lib/dhcp/dhcpd.leases"}
+	}
+	for _, path := range dhcpdLeases {
+		sources = append(sources, deviceid.DHCPDLeases(path))
+	}
+	sources = append(sources,
+		deviceid.Ethers(orDefault(config.Ethers, "/etc/ethers")),
+		deviceid.ARPTable(orDefault(config.ARPTable, "/proc/net/arp")))
+	return deviceid.NewResolver(sources, vendors, forgetAfter), nil
+}
+
+type deviceGroup struct {
+	name         string
+	macAddresses []string
+}
+
+// usage returns the bytes sent to and received from all devices of the
+// group, on all LAN interfaces.
+func (g *deviceGroup) usage(windowName, since string) float64 {
+	rxValues := lanL4DeviceRxBytesCounter.Values(windowName, since)
+	txValues := lanL4DeviceTxBytesCounter.Values(windowName, since)
+	var total float64
+	for _, mac := range g.macAddresses {
+		total += sumInterfaces(rxValues, []string{mac})
+		total += sumInterfaces(txValues, []string{mac})
+	}
+	return total
+}
+
+// setupDeviceGroups parses the device groups in config, and adds quotas for
+// those with an allowance to engine. It returns windows extended with any
+// additional windows the quotas are measured over.
+func setupDeviceGroups(config *recorderConfig, engine *quota.Engine, windows []*window.Window) ([]*deviceGroup, []*window.Window, error) {
+	var groups []*deviceGroup
+	for _, groupConfig := range config.DeviceGroups {
+		if groupConfig.Name == "" {
+			return nil, nil, fmt.Errorf("device group must have a name")
+		}
+		group := &deviceGroup{name: groupConfig.Name}
+		for _, mac := range groupConfig.MACAddresses {
+			addr, err := net.ParseMAC(mac)
+			if err != nil {
+				return nil, nil, fmt.Errorf("device group %s: %v", groupConfig.Name, err)
+			}
+			// Normalized to match the mac_address label of the counters.
+			group.macAddresses = append(group.macAddresses, addr.String())
+		}
+		groups = append(groups, group)
+
+		if groupConfig.AllowanceBytes == 0 {
+			continue
+		}
+		q, err := quota.New(quota.Config{
+			Name:       deviceQuotaPrefix + groupConfig.Name,
+			CapBytes:   groupConfig.AllowanceBytes,
+			Window:     groupConfig.Window,
+			Thresholds: groupConfig.Thresholds,
+			Notify:     groupConfig.Notify,
+		}, group.usage)
+		if err != nil {
+			return nil, nil, err
+		}
+		windows, err = addWindow(windows, q.Window)
+		if err != nil {
+			return nil, nil, fmt.Errorf("device group %s: %v", groupConfig.Name, err)
+		}
+		engine.Add(q)
+	}
+	return groups, windows, nil
+}
+
+type deviceUsage struct {
+	Name       string   `json:"name"`
+	Hostname   string   `json:"hostname,omitempty"`
+	IP         string   `json:"ip,omitempty"`
+	Vendor     string   `json:"vendor,omitempty"`
+	Devices    []string `json:"mac_addresses,omitempty"`
+	RxBytes    float64  `json:"rx_bytes"`
+	TxBytes    float64  `json:"tx_bytes"`
+	TotalBytes float64  `json:"total_bytes"`
+	// Share is the fraction of the traffic of all devices.
+	Share float64 `json:"share"`
+}
+
+type deviceReport struct {
+	Window  string         `json:"window"`
+	Since   string         `json:"since"`
+	Total   float64        `json:"total_bytes"`
+	Devices []*deviceUsage `json:"devices"`
+	Groups  []*deviceUsage `json:"groups"`
+}
+
+func newDeviceReport(w *window.Window, since string, groups []*deviceGroup, resolver *deviceid.Resolver) *deviceReport {
+	report := &deviceReport{
+		Window: w.Name(),
+		Since:  since,
+	}
+	macToUsage := make(map[string]*deviceUsage)
+	usageOf := func(mac string) *deviceUsage {
+		usage, ok := macToUsage[mac]
+		if !ok {
+			identity := resolver.Lookup(mac)
+			usage = &deviceUsage{
+				Name:     mac,
+				Hostname: identity.Hostname,
+				IP:       identity.IP,
+				Vendor:   identity.Vendor,
+			}
+			macToUsage[mac] = usage
+			report.Devices = append(report.Devices, usage)
+		}
+		return usage
+	}
+	// Devices are reported across all LAN interfaces.
+	for _, value := range lanL4DeviceRxBytesCounter.Values(w.Name(), since) {
+		usageOf(value.Labels[1]).RxBytes += value.Value
+	}
+	for _, value := range lanL4DeviceTxBytesCounter.Values(w.Name(), since) {
+		usageOf(value.Labels[1]).TxBytes += value.Value
+	}
+	for _, usage := range report.Devices {
+		usage.TotalBytes = usage.RxBytes + usage.TxBytes
+		report.Total += usage.TotalBytes
+	}
+
+	for _, group := range groups {
+		groupUsage := &deviceUsage{
+			Name:    group.name,
+			Devices: group.macAddresses,
+		}
+		for _, mac := range group.macAddresses {
+			if usage, ok := macToUsage[mac]; ok {
+				groupUsage.RxBytes += usage.RxBytes
+				groupUsage.TxBytes += usage.TxBytes
+			}
+		}
+		groupUsage.TotalBytes = groupUsage.RxBytes + groupUsage.TxBytes
+		report.Groups = append(report.Groups, groupUsage)
+	}
+
+	for _, usages := range [][]*deviceUsage{report.Devices, report.Groups} {
+		for _, usage := range usages {
+			if report.Total > 0 {
+				usage.Share = usage.TotalBytes / report.Total
+			}
+		}
+		sort.Slice(usages, func(i, j int) bool {
+			return usages[i].TotalBytes > usages[j].TotalBytes
+		})
+	}
+	return report
+}
+
+func (r *deviceReport) writeText(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Window %s since %s: %.0f bytes total\n\n", r.Window, r.Since, r.Total)
+	for _, section := range []struct {
+		title  string
+		usages []*deviceUsage
+	}{
+		{"DEVICE", r.Devices},
+		{"GROUP", r.Groups},
+	} {
+		if len(section.usages) == 0 {
+			continue
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "%s\tRX BYTES\tTX BYTES\tTOTAL BYTES\tSHARE\t\n", section.title)
+		for _, usage := range section.usages {
+			name := usage.Name
+			if usage.Hostname != "" {
+				name = fmt.Sprintf("%s (%s)", usage.Hostname, usage.Name)
+			}
+			fmt.Fprintf(tw, "%s\t%.0f\t%.0f\t%.0f\t%.1f%%\t\n", name,
+				usage.RxBytes, usage.TxBytes, usage.TotalBytes, usage.Share*100)
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+}
+
+// deviceReportHandler serves the usage of each LAN device and device group
+// in the current period of a window, as a text table or, with format=json,
+// as JSON. The window is selected by the window parameter, and defaults to
+// the first configured window.
+func deviceReportHandler(windows []*window.Window, groups []*deviceGroup, resolver *deviceid.Resolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selected := windows[0]
+		if name := r.FormValue("window"); name != "" {
+			selected = nil
+			for _, candidate := range windows {
+				if candidate.Name() == name {
+					selected = candidate
+				}
+			}
+			if selected == nil {
+				http.Error(w, fmt.Sprintf("unknown window %q", name), http.StatusNotFound)
+				return
+			}
+		}
+		since := r.FormValue("since")
+		if since == "" {
+			since = selected.Since(time.Now())
+		}
+
+		report := newDeviceReport(selected, since, groups, resolver)
+		if strings.ToLower(r.FormValue("format")) == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+		report.writeText(w)
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/interarticle/bandwidth_recorder/layerinfo"
+	"github.com/interarticle/bandwidth_recorder/packetsource"
+)
+
+// Strategies by which packets are classified as sent or received on an
+// interface, selected by interfaceConfig.Direction.
+const (
+	directionByMAC    = "mac"
+	directionByIP     = "ip"
+	directionByPrefix = "prefix"
+	directionByPcap   = "pcap"
+)
+
+// getAssignedAddresses returns the IP addresses assigned to intf, including
+// those with a network mask, as Linux returns them.
+func getAssignedAddresses(intf *net.Interface) ([]net.IP, error) {
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var outAddrs []net.IP
+	for _, addr := range addrs {
+		switch addr := addr.(type) {
+		case *net.IPAddr:
+			outAddrs = append(outAddrs, addr.IP)
+		case *net.IPNet:
+			outAddrs = append(outAddrs, addr.IP)
+		}
+	}
+	return outAddrs, nil
+}
+
+// watchLocalAddresses returns the IP addresses of dev as returned by get,
+// kept up to date every second if dev is captured live.
+func watchLocalAddresses(dev *monitoredDevice, live bool, get func(*net.Interface) ([]net.IP, error)) (*atomic.Value, error) {
+	localAddresses := &atomic.Value{} // []net.IP
+	localAddresses.Store([]net.IP(nil))
+	if dev.intf == nil {
+		return localAddresses, nil
+	}
+	localIPs, err := get(dev.intf)
+	if err != nil {
+		return nil, err
+	}
+	localAddresses.Store(localIPs)
+	if live {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+
+				localIPs, err := get(dev.intf)
+				if err != nil {
+					log.Fatalf("Failed to update IP addresses of %v: %v", dev, err)
+				}
+				localAddresses.Store(localIPs)
+			}
+		}()
+	}
+	return localAddresses, nil
+}
+
+// directionClassifier tells whether packets on an interface were sent or
+// received by this host, by the strategy configured for the interface.
+type directionClassifier struct {
+	strategy     string
+	hardwareAddr net.HardwareAddr
+	// localAddresses is only set for directionByIP.
+	localAddresses *atomic.Value // []net.IP
+	prefixes       []*net.IPNet
+	// prefixesAreRemote is set on LAN interfaces, where the prefixes are
+	// those of the devices packets are sent to rather than from.
+	prefixesAreRemote bool
+}
+
+// validateDirection checks the direction settings of an interface.
+func validateDirection(label string, config interfaceConfig, lan bool) error {
+	switch config.Direction {
+	case "", directionByMAC:
+	case directionByPcap:
+		if config.Capture.Backend != "" && config.Capture.Backend != packetsource.BackendPcap {
+			return fmt.Errorf("interface %s: direction %q needs the %s capture backend", label, config.Direction, packetsource.BackendPcap)
+		}
+	case directionByIP:
+		if lan {
+			return fmt.Errorf("interface %s: direction %q does not apply to LAN interfaces, whose traffic to and from this host is not accounted", label, config.Direction)
+		}
+	case directionByPrefix:
+		if len(config.Prefixes) == 0 {
+			return fmt.Errorf("interface %s: direction %q needs prefixes", label, config.Direction)
+		}
+	default:
+		return fmt.Errorf("interface %s: unknown direction %q", label, config.Direction)
+	}
+	for _, prefix := range config.Prefixes {
+		_, _, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return fmt.Errorf("interface %s: %v", label, err)
+		}
+	}
+	return nil
+}
+
+func newDirectionClassifier(dev *monitoredDevice, live, lan bool) (*directionClassifier, error) {
+	c := &directionClassifier{
+		strategy:          dev.config.Direction,
+		hardwareAddr:      dev.hardwareAddr,
+		prefixesAreRemote: lan,
+	}
+	if c.strategy == "" {
+		c.strategy = directionByMAC
+	}
+	for _, prefix := range dev.config.Prefixes {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		c.prefixes = append(c.prefixes, ipNet)
+	}
+	if c.strategy == directionByIP {
+		var err error
+		c.localAddresses, err = watchLocalAddresses(dev, live, getAssignedAddresses)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *directionClassifier) inPrefixes(ip net.IP) bool {
+	for _, prefix := range c.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify returns whether a packet was sent (DirectionOut) or received
+// (DirectionIn) on the interface, given its breakdown b.
+func (c *directionClassifier) classify(packet gopacket.Packet, b *layerinfo.Breakdown) packetsource.Direction {
+	switch c.strategy {
+	case directionByIP:
+		for _, ip := range c.localAddresses.Load().([]net.IP) {
+			if ip.Equal(b.SrcIP) {
+				return packetsource.DirectionOut
+			}
+			if ip.Equal(b.DstIP) {
+				return packetsource.DirectionIn
+			}
+		}
+	case directionByPrefix:
+		from, to := c.inPrefixes(b.SrcIP), c.inPrefixes(b.DstIP)
+		if c.prefixesAreRemote {
+			from, to = to, from
+		}
+		switch {
+		case from && !to:
+			return packetsource.DirectionOut
+		case to && !from:
+			return packetsource.DirectionIn
+		}
+	case directionByPcap:
+		return packetsource.PacketDirection(packet)
+	default:
+		switch {
+		case b.SrcMAC != nil && bytes.Equal(b.SrcMAC, c.hardwareAddr):
+			return packetsource.DirectionOut
+		case b.DstMAC != nil && bytes.Equal(b.DstMAC, c.hardwareAddr):
+			return packetsource.DirectionIn
+		}
+	}
+	return packetsource.DirectionUnknown
+}
+
+// peers returns how the sender and receiver of a packet on a LAN interface
+// are identified: by MAC address on Ethernet, or else by IP address.
+func peers(b *layerinfo.Breakdown) (src, dst string) {
+	if _, ok := b.Link.(*layers.Ethernet); ok {
+		return b.SrcMAC.String(), b.DstMAC.String()
+	}
+	return b.SrcIP.String(), b.DstIP.String()
+}
@@ -0,0 +1,166 @@
+package flow
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Record is the JSON representation of a flow.
+type Record struct {
+	Protocol uint8  `json:"protocol"`
+	AIP      string `json:"a_ip"`
+	APort    uint16 `json:"a_port"`
+	BIP      string `json:"b_ip"`
+	BPort    uint16 `json:"b_port"`
+	// Local is true if A is the local endpoint.
+	Local          bool      `json:"local"`
+	Start          time.Time `json:"start"`
+	Last           time.Time `json:"last"`
+	ForwardBytes   uint64    `json:"forward_bytes"`
+	ForwardPackets uint64    `json:"forward_packets"`
+	ReverseBytes   uint64    `json:"reverse_bytes"`
+	ReversePackets uint64    `json:"reverse_packets"`
+
+	WindowBytes uint64       `json:"window_bytes,omitempty"`
+	Active      bool         `json:"active,omitempty"`
+	Reason      ExpiryReason `json:"reason,omitempty"`
+}
+
+func (f *Flow) Record() *Record {
+	return &Record{
+		Protocol:       f.Key.Protocol,
+		AIP:            f.Key.A().String(),
+		APort:          f.Key.APort,
+		BIP:            f.Key.B().String(),
+		BPort:          f.Key.BPort,
+		Local:          f.Local,
+		Start:          f.Start,
+		Last:           f.Last,
+		ForwardBytes:   f.ForwardBytes,
+		ForwardPackets: f.ForwardPackets,
+		ReverseBytes:   f.ReverseBytes,
+		ReversePackets: f.ReversePackets,
+	}
+}
+
+// Log appends expired flows to a file as JSON lines, for later analysis.
+type Log struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func OpenLog(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, w: bufio.NewWriter(f)}
+	go func() {
+		// Flush periodically, so that the file is useful while the
+		// recorder runs.
+		for range time.Tick(10 * time.Second) {
+			l.Flush()
+		}
+	}()
+	return l, nil
+}
+
+// Write is suitable as Config.OnExpire.
+func (l *Log) Write(f *Flow, reason ExpiryReason) {
+	record := f.Record()
+	record.Reason = reason
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: failed to encode flow: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(data)
+	l.w.WriteByte('\n')
+}
+
+func (l *Log) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	if err != nil {
+		log.Printf("Warning: failed to write flow log: %v", err)
+	}
+}
+
+func parseTopQuery(r *http.Request) (int, time.Duration, error) {
+	n := 10
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, 0, strconv.ErrSyntax
+		}
+	}
+	window := 5 * time.Minute
+	if s := r.FormValue("window"); s != "" {
+		var err error
+		window, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return n, window, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// TopFlowsHandler serves the top flows as JSON. The n and window parameters
+// select how many flows over which sliding window, e.g. n=20&window=15m.
+func TopFlowsHandler(t *Table) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, window, err := parseTopQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var records []*Record
+		for _, stat := range t.TopFlows(n, window, time.Now()) {
+			record := stat.Flow.Record()
+			record.WindowBytes = stat.WindowBytes
+			record.Active = stat.Active
+			records = append(records, record)
+		}
+		writeJSON(w, records)
+	})
+}
+
+type hostRecord struct {
+	IP          string `json:"ip"`
+	WindowBytes uint64 `json:"window_bytes"`
+}
+
+// TopHostsHandler serves the top remote hosts as JSON, with the same
+// parameters as TopFlowsHandler.
+func TopHostsHandler(t *Table) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, window, err := parseTopQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var records []hostRecord
+		for _, stat := range t.TopHosts(n, window, time.Now()) {
+			records = append(records, hostRecord{IP: stat.IP.String(), WindowBytes: stat.WindowBytes})
+		}
+		writeJSON(w, records)
+	})
+}
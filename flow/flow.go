@@ -0,0 +1,98 @@
+// Package flow tracks bidirectional flows of packets between pairs of
+// endpoints, and the hosts and flows exchanging the most traffic over
+// sliding windows.
+package flow
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// Direction is that of a packet relative to the local network.
+type Direction int
+
+const (
+	DirectionUnknown Direction = iota
+	// DirectionOutbound packets are sent from the local network.
+	DirectionOutbound
+	// DirectionInbound packets are received by the local network.
+	DirectionInbound
+)
+
+// Packet is what the table needs to know about a packet.
+type Packet struct {
+	Time time.Time
+	// Protocol is the IP protocol number, e.g. 6 for TCP.
+	Protocol         uint8
+	SrcIP, DstIP     net.IP
+	SrcPort, DstPort uint16
+	Bytes            uint64
+	Direction        Direction
+}
+
+// Key identifies a flow. When the direction of its packets is known, A is the
+// local endpoint and B the remote one; otherwise the endpoints are ordered by
+// address, so that both directions map to the same key.
+type Key struct {
+	Protocol uint8
+	AIP, BIP [net.IPv6len]byte
+	APort    uint16
+	BPort    uint16
+}
+
+func toArray(ip net.IP) [net.IPv6len]byte {
+	var a [net.IPv6len]byte
+	copy(a[:], ip.To16())
+	return a
+}
+
+// keyOf returns the key of p, and whether p travels from A to B.
+func keyOf(p *Packet) (Key, bool) {
+	src, dst := toArray(p.SrcIP), toArray(p.DstIP)
+	forward := true
+	switch p.Direction {
+	case DirectionInbound:
+		forward = false
+	case DirectionUnknown:
+		if c := bytes.Compare(src[:], dst[:]); c > 0 || (c == 0 && p.SrcPort > p.DstPort) {
+			forward = false
+		}
+	}
+	if forward {
+		return Key{Protocol: p.Protocol, AIP: src, BIP: dst, APort: p.SrcPort, BPort: p.DstPort}, true
+	}
+	return Key{Protocol: p.Protocol, AIP: dst, BIP: src, APort: p.DstPort, BPort: p.SrcPort}, false
+}
+
+func (k Key) A() net.IP {
+	return net.IP(k.AIP[:]).To16()
+}
+
+func (k Key) B() net.IP {
+	return net.IP(k.BIP[:]).To16()
+}
+
+// Flow holds the counts of a flow. Forward counts are of packets from A to
+// B, and reverse counts of those from B to A.
+type Flow struct {
+	Key Key
+	// Local is true if A is known to be the local endpoint.
+	Local bool
+
+	Start, Last    time.Time
+	ForwardBytes   uint64
+	ForwardPackets uint64
+	ReverseBytes   uint64
+	ReversePackets uint64
+}
+
+// ExpiryReason says why a flow ended.
+type ExpiryReason string
+
+const (
+	ExpiredIdle    ExpiryReason = "idle"
+	ExpiredActive  ExpiryReason = "active"
+	ExpiredEvicted ExpiryReason = "evicted"
+	ExpiredFlushed ExpiryReason = "flushed"
+)
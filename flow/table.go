@@ -0,0 +1,329 @@
+package flow
+
+import (
+	"container/list"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config controls the limits and timeouts of a Table.
+type Config struct {
+	// Flows without packets for IdleTimeout end.
+	IdleTimeout time.Duration
+	// Flows lasting longer than ActiveTimeout end, and further packets
+	// start a new flow.
+	ActiveTimeout time.Duration
+	// MaxFlows bounds the number of tracked flows. When it is reached, the
+	// least recently active flow is evicted.
+	MaxFlows int
+
+	// The traffic of flows and hosts is kept in Buckets buckets of
+	// BucketWidth each, bounding the sliding windows which can be queried.
+	// Only the top MaxBucketEntries flows and hosts of each bucket are
+	// kept.
+	BucketWidth      time.Duration
+	Buckets          int
+	MaxBucketEntries int
+
+	// OnExpire, if set, is called with each flow which ends. It is not
+	// called with the table locked.
+	OnExpire func(f *Flow, reason ExpiryReason)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		IdleTimeout:      time.Minute,
+		ActiveTimeout:    30 * time.Minute,
+		MaxFlows:         65536,
+		BucketWidth:      10 * time.Second,
+		Buckets:          360,
+		MaxBucketEntries: 1000,
+	}
+}
+
+type bucket struct {
+	start time.Time
+	flows map[Key]uint64
+	hosts map[[net.IPv6len]byte]uint64
+}
+
+func newBucket(start time.Time) *bucket {
+	return &bucket{
+		start: start,
+		flows: make(map[Key]uint64),
+		hosts: make(map[[net.IPv6len]byte]uint64),
+	}
+}
+
+// truncate keeps only the n largest entries of the bucket.
+func (b *bucket) truncate(n int) {
+	if len(b.flows) > n {
+		var counts []uint64
+		for _, c := range b.flows {
+			counts = append(counts, c)
+		}
+		sort.Slice(counts, func(i, j int) bool { return counts[i] > counts[j] })
+		min := counts[n-1]
+		for k, c := range b.flows {
+			if c < min {
+				delete(b.flows, k)
+			}
+		}
+	}
+	if len(b.hosts) > n {
+		var counts []uint64
+		for _, c := range b.hosts {
+			counts = append(counts, c)
+		}
+		sort.Slice(counts, func(i, j int) bool { return counts[i] > counts[j] })
+		min := counts[n-1]
+		for k, c := range b.hosts {
+			if c < min {
+				delete(b.hosts, k)
+			}
+		}
+	}
+}
+
+type expiredFlow struct {
+	flow   *Flow
+	reason ExpiryReason
+}
+
+// Table tracks flows. It is safe for concurrent use.
+type Table struct {
+	config Config
+
+	mu    sync.Mutex
+	flows map[Key]*list.Element
+	// lru orders flows from least to most recently active.
+	lru     *list.List
+	current *bucket
+	history []*bucket
+}
+
+func NewTable(config Config) *Table {
+	return &Table{
+		config: config,
+		flows:  make(map[Key]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// Observe accounts a packet to its flow.
+func (t *Table) Observe(p *Packet) {
+	key, forward := keyOf(p)
+
+	t.mu.Lock()
+	t.rotateLocked(p.Time)
+	// Flows also expire by packet time, so that idle flows end when packets
+	// are replayed faster than in real time.
+	expired := t.expireIdleLocked(p.Time)
+
+	elem, ok := t.flows[key]
+	if ok {
+		switch f := elem.Value.(*Flow); {
+		case p.Time.Sub(f.Last) > t.config.IdleTimeout:
+			expired = append(expired, expiredFlow{t.removeLocked(elem), ExpiredIdle})
+			ok = false
+		case p.Time.Sub(f.Start) > t.config.ActiveTimeout:
+			expired = append(expired, expiredFlow{t.removeLocked(elem), ExpiredActive})
+			ok = false
+		}
+	}
+	if !ok {
+		if t.config.MaxFlows > 0 && len(t.flows) >= t.config.MaxFlows {
+			expired = append(expired, expiredFlow{t.removeLocked(t.lru.Front()), ExpiredEvicted})
+		}
+		elem = t.lru.PushBack(&Flow{
+			Key:   key,
+			Local: p.Direction != DirectionUnknown,
+			Start: p.Time,
+		})
+		t.flows[key] = elem
+	} else {
+		t.lru.MoveToBack(elem)
+	}
+
+	f := elem.Value.(*Flow)
+	f.Last = p.Time
+	if forward {
+		f.ForwardBytes += p.Bytes
+		f.ForwardPackets++
+	} else {
+		f.ReverseBytes += p.Bytes
+		f.ReversePackets++
+	}
+	t.current.flows[key] += p.Bytes
+	if f.Local {
+		t.current.hosts[key.BIP] += p.Bytes
+	}
+	t.mu.Unlock()
+
+	t.notify(expired)
+}
+
+func (t *Table) removeLocked(elem *list.Element) *Flow {
+	f := t.lru.Remove(elem).(*Flow)
+	delete(t.flows, f.Key)
+	return f
+}
+
+// rotateLocked makes the current bucket the one containing now.
+func (t *Table) rotateLocked(now time.Time) {
+	start := now.Truncate(t.config.BucketWidth)
+	if t.current != nil && !start.After(t.current.start) {
+		return
+	}
+	if t.current != nil {
+		t.current.truncate(t.config.MaxBucketEntries)
+		t.history = append(t.history, t.current)
+		if len(t.history) > t.config.Buckets {
+			t.history = t.history[len(t.history)-t.config.Buckets:]
+		}
+	}
+	t.current = newBucket(start)
+}
+
+func (t *Table) notify(expired []expiredFlow) {
+	if t.config.OnExpire == nil {
+		return
+	}
+	for _, e := range expired {
+		t.config.OnExpire(e.flow, e.reason)
+	}
+}
+
+// Expire ends flows which have been idle for longer than the idle timeout as
+// of now.
+func (t *Table) Expire(now time.Time) {
+	t.mu.Lock()
+	t.rotateLocked(now)
+	expired := t.expireIdleLocked(now)
+	t.mu.Unlock()
+
+	t.notify(expired)
+}
+
+// expireIdleLocked removes the flows which have been idle for longer than
+// the idle timeout as of now.
+func (t *Table) expireIdleLocked(now time.Time) []expiredFlow {
+	var expired []expiredFlow
+	for elem := t.lru.Front(); elem != nil; elem = t.lru.Front() {
+		if now.Sub(elem.Value.(*Flow).Last) <= t.config.IdleTimeout {
+			break
+		}
+		expired = append(expired, expiredFlow{t.removeLocked(elem), ExpiredIdle})
+	}
+	return expired
+}
+
+// Flush ends all flows, such as on shutdown.
+func (t *Table) Flush() {
+	t.mu.Lock()
+	var expired []expiredFlow
+	for elem := t.lru.Front(); elem != nil; elem = t.lru.Front() {
+		expired = append(expired, expiredFlow{t.removeLocked(elem), ExpiredFlushed})
+	}
+	t.mu.Unlock()
+
+	t.notify(expired)
+}
+
+// Run expires idle flows every interval until stop is closed.
+func (t *Table) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.Expire(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Len returns the number of flows being tracked.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// FlowStat is the traffic of a flow within a window.
+type FlowStat struct {
+	Flow
+	// WindowBytes is the traffic in both directions within the window.
+	WindowBytes uint64
+	// Active is false if the flow has ended; then only its key and
+	// WindowBytes are set.
+	Active bool
+}
+
+// HostStat is the traffic exchanged with a remote host within a window.
+type HostStat struct {
+	IP          net.IP
+	WindowBytes uint64
+}
+
+// bucketsLocked returns the buckets within window of now.
+func (t *Table) bucketsLocked(window time.Duration, now time.Time) []*bucket {
+	t.rotateLocked(now)
+	since := now.Add(-window)
+	buckets := []*bucket{t.current}
+	for i := len(t.history) - 1; i >= 0 && !t.history[i].start.Add(t.config.BucketWidth).Before(since); i-- {
+		buckets = append(buckets, t.history[i])
+	}
+	return buckets
+}
+
+// TopFlows returns the n flows with the most traffic within window of now.
+func (t *Table) TopFlows(n int, window time.Duration, now time.Time) []FlowStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	totals := make(map[Key]uint64)
+	for _, b := range t.bucketsLocked(window, now) {
+		for k, c := range b.flows {
+			totals[k] += c
+		}
+	}
+	var stats []FlowStat
+	for k, c := range totals {
+		stat := FlowStat{Flow: Flow{Key: k}, WindowBytes: c}
+		if elem, ok := t.flows[k]; ok {
+			stat.Flow = *elem.Value.(*Flow)
+			stat.Active = true
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].WindowBytes > stats[j].WindowBytes })
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// TopHosts returns the n remote hosts with the most traffic within window
+// of now. Only flows whose direction is known contribute.
+func (t *Table) TopHosts(n int, window time.Duration, now time.Time) []HostStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	totals := make(map[[net.IPv6len]byte]uint64)
+	for _, b := range t.bucketsLocked(window, now) {
+		for ip, c := range b.hosts {
+			totals[ip] += c
+		}
+	}
+	var stats []HostStat
+	for ip, c := range totals {
+		stats = append(stats, HostStat{IP: net.IP(append([]byte(nil), ip[:]...)), WindowBytes: c})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].WindowBytes > stats[j].WindowBytes })
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
@@ -0,0 +1,302 @@
+// Package flowexport sends flow records to a collector over UDP as NetFlow
+// v9 (RFC 3954) or IPFIX (RFC 7011).
+package flowexport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/flow"
+)
+
+// maxMessageSize keeps messages within a typical path MTU.
+const maxMessageSize = 1400
+
+type Config struct {
+	// Collector is the host:port to send records to.
+	Collector string
+	// Version is 9 for NetFlow v9 or 10 for IPFIX.
+	Version int
+	// Templates are resent every TemplateRefresh, so collectors which
+	// start after the exporter learn them.
+	TemplateRefresh time.Duration
+	// SamplingInterval is N when 1 in N packets is accounted. It is
+	// announced to the collector in an options record.
+	SamplingInterval uint32
+	// ObservationDomain is the NetFlow v9 source ID or IPFIX observation
+	// domain ID.
+	ObservationDomain uint32
+}
+
+// Exporter batches flow records into messages to a collector. It is safe
+// for concurrent use.
+type Exporter struct {
+	config    Config
+	conn      net.Conn
+	ipfix     bool
+	templates []*template
+	options   *template
+	bootTime  time.Time
+
+	mu              sync.Mutex
+	pending         map[uint16][][]byte
+	lastTemplates   time.Time
+	sequence        uint32
+	recordsExported uint32
+}
+
+func New(config Config) (*Exporter, error) {
+	if config.Version != 9 && config.Version != 10 {
+		return nil, fmt.Errorf("unsupported flow export version %d", config.Version)
+	}
+	if config.SamplingInterval == 0 {
+		config.SamplingInterval = 1
+	}
+	conn, err := net.Dial("udp", config.Collector)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		config:    config,
+		conn:      conn,
+		ipfix:     config.Version == 10,
+		templates: flowTemplates(config.Version == 10),
+		bootTime:  time.Now(),
+		pending:   make(map[uint16][][]byte),
+	}
+	scopeID := uint16(scopeSystem)
+	if e.ipfix {
+		scopeID = fieldObservationDomain
+	}
+	e.options = &template{
+		id: templateIDOptions,
+		fields: []field{
+			{scopeID, 4},
+			{fieldSamplingInterval, 4},
+			{fieldSamplingAlgorithm, 1},
+		},
+	}
+	return e, nil
+}
+
+func (e *Exporter) encodeRecord(r *record) (uint16, []byte) {
+	var b []byte
+	templateID := uint16(templateIDIPv6)
+	if src4, dst4 := r.srcIP.To4(), r.dstIP.To4(); src4 != nil && dst4 != nil {
+		templateID = templateIDIPv4
+		b = append(b, src4...)
+		b = append(b, dst4...)
+	} else {
+		b = append(b, r.srcIP.To16()...)
+		b = append(b, r.dstIP.To16()...)
+	}
+	b = appendUint64(b, r.bytes)
+	b = appendUint64(b, r.packets)
+	b = append(b, r.protocol)
+	b = appendUint16(b, r.srcPort)
+	b = appendUint16(b, r.dstPort)
+	b = append(b, r.direction)
+	if e.ipfix {
+		b = appendUint64(b, uint64(r.start))
+		b = appendUint64(b, uint64(r.end))
+	} else {
+		b = appendUint32(b, e.uptime(r.start))
+		b = appendUint32(b, e.uptime(r.end))
+	}
+	return templateID, b
+}
+
+// uptime converts Unix milliseconds to NetFlow v9 system uptime. Flows from
+// before the exporter started, as when replaying captures, are clamped to
+// zero.
+func (e *Exporter) uptime(unixMillis int64) uint32 {
+	ms := unixMillis - e.bootTime.UnixNano()/1e6
+	if ms < 0 {
+		return 0
+	}
+	return uint32(ms)
+}
+
+// Export queues the records of an ended flow. It is suitable as
+// flow.Config.OnExpire.
+func (e *Exporter) Export(f *flow.Flow, reason flow.ExpiryReason) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range splitFlow(f) {
+		templateID, data := e.encodeRecord(r)
+		e.pending[templateID] = append(e.pending[templateID], data)
+	}
+}
+
+// set frames records as a flowset (NetFlow v9) or set (IPFIX), padded to a
+// multiple of 4 bytes.
+func set(id uint16, records [][]byte) []byte {
+	length := 4
+	for _, r := range records {
+		length += len(r)
+	}
+	padding := (4 - length%4) % 4
+	b := make([]byte, 0, length+padding)
+	b = appendUint16(b, id)
+	b = appendUint16(b, uint16(length+padding))
+	for _, r := range records {
+		b = append(b, r...)
+	}
+	return append(b, make([]byte, padding)...)
+}
+
+func (e *Exporter) templateSets() (sets [][]byte, records int) {
+	var templateRecords [][]byte
+	for _, t := range e.templates {
+		templateRecords = append(templateRecords, t.encode(nil))
+	}
+
+	var optionsTemplate []byte
+	optionsTemplate = appendUint16(optionsTemplate, e.options.id)
+	if e.ipfix {
+		// Field count, scope field count, then fields.
+		optionsTemplate = appendUint16(optionsTemplate, uint16(len(e.options.fields)))
+		optionsTemplate = appendUint16(optionsTemplate, 1)
+	} else {
+		// Scope length and option length in bytes, then fields.
+		optionsTemplate = appendUint16(optionsTemplate, 4)
+		optionsTemplate = appendUint16(optionsTemplate, uint16(4*(len(e.options.fields)-1)))
+	}
+	for _, f := range e.options.fields {
+		optionsTemplate = appendUint16(optionsTemplate, f.id)
+		optionsTemplate = appendUint16(optionsTemplate, f.length)
+	}
+
+	var optionsData []byte
+	optionsData = appendUint32(optionsData, e.config.ObservationDomain)
+	optionsData = appendUint32(optionsData, e.config.SamplingInterval)
+	optionsData = append(optionsData, samplingAlgorithmDeterministic)
+
+	templateSetID, optionsSetID := uint16(0), uint16(1)
+	if e.ipfix {
+		templateSetID, optionsSetID = 2, 3
+	}
+	return [][]byte{
+		set(templateSetID, templateRecords),
+		set(optionsSetID, [][]byte{optionsTemplate}),
+		set(e.options.id, [][]byte{optionsData}),
+	}, len(templateRecords) + 2
+}
+
+// message wraps sets in a NetFlow v9 or IPFIX header. records is the number
+// of records in the sets, and dataRecords the number of flow records.
+func (e *Exporter) message(now time.Time, sets [][]byte, records, dataRecords int) []byte {
+	length := 0
+	for _, s := range sets {
+		length += len(s)
+	}
+	var b []byte
+	if e.ipfix {
+		b = appendUint16(b, 10)
+		b = appendUint16(b, uint16(16+length))
+		b = appendUint32(b, uint32(now.Unix()))
+		// IPFIX sequence numbers count data records sent before this
+		// message.
+		b = appendUint32(b, e.recordsExported)
+		b = appendUint32(b, e.config.ObservationDomain)
+		e.recordsExported += uint32(dataRecords)
+	} else {
+		b = appendUint16(b, 9)
+		b = appendUint16(b, uint16(records))
+		b = appendUint32(b, uint32(now.Sub(e.bootTime)/time.Millisecond))
+		b = appendUint32(b, uint32(now.Unix()))
+		// NetFlow v9 sequence numbers count messages.
+		b = appendUint32(b, e.sequence)
+		b = appendUint32(b, e.config.ObservationDomain)
+		e.sequence++
+	}
+	for _, s := range sets {
+		b = append(b, s...)
+	}
+	return b
+}
+
+// Flush sends all queued records, along with the templates if they are due
+// to be refreshed.
+func (e *Exporter) Flush(now time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var messages [][]byte
+	var sets [][]byte
+	size, records, dataRecords := 0, 0, 0
+	if now.Sub(e.lastTemplates) >= e.config.TemplateRefresh {
+		var n int
+		sets, n = e.templateSets()
+		for _, s := range sets {
+			size += len(s)
+		}
+		records += n
+		e.lastTemplates = now
+	}
+	for templateID, pending := range e.pending {
+		for len(pending) > 0 {
+			// Take as many records as fit in the current message.
+			room := maxMessageSize - 20 - size - 4 - 3
+			n := 0
+			for used := 0; n < len(pending) && used+len(pending[n]) <= room; n++ {
+				used += len(pending[n])
+			}
+			if n == 0 {
+				if size == 0 {
+					return errors.New("flow record exceeds maximum message size")
+				}
+				messages = append(messages, e.message(now, sets, records, dataRecords))
+				sets, size, records, dataRecords = nil, 0, 0, 0
+				continue
+			}
+			s := set(templateID, pending[:n])
+			sets = append(sets, s)
+			size += len(s)
+			records += n
+			dataRecords += n
+			pending = pending[n:]
+		}
+		delete(e.pending, templateID)
+	}
+	if len(sets) > 0 {
+		messages = append(messages, e.message(now, sets, records, dataRecords))
+	}
+
+	for _, m := range messages {
+		_, err := e.conn.Write(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run flushes queued records every interval until stop is closed.
+func (e *Exporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			err := e.Flush(now)
+			if err != nil {
+				log.Printf("Warning: failed to export flows: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (e *Exporter) Close() error {
+	err := e.Flush(time.Now())
+	if closeErr := e.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/interarticle/bandwidth_recorder/flow"
+)
+
+// Information element (field type) numbers, shared by NetFlow v9 and IPFIX.
+const (
+	fieldInBytes           = 1
+	fieldInPackets         = 2
+	fieldProtocol          = 4
+	fieldL4SrcPort         = 7
+	fieldIPv4SrcAddr       = 8
+	fieldL4DstPort         = 11
+	fieldIPv4DstAddr       = 12
+	fieldLastSwitched      = 21
+	fieldFirstSwitched     = 22
+	fieldIPv6SrcAddr       = 27
+	fieldIPv6DstAddr       = 28
+	fieldSamplingInterval  = 34
+	fieldSamplingAlgorithm = 35
+	fieldFlowDirection     = 61
+	fieldObservationDomain = 149
+	fieldFlowStartMillis   = 152
+	fieldFlowEndMillis     = 153
+
+	// NetFlow v9 options scope field type for the exporting system.
+	scopeSystem = 1
+)
+
+const (
+	templateIDIPv4    = 256
+	templateIDIPv6    = 257
+	templateIDOptions = 258
+
+	// Deterministic sampling, as NetFlow v9 defines SAMPLING_ALGORITHM.
+	samplingAlgorithmDeterministic = 1
+
+	directionIngress = 0
+	directionEgress  = 1
+)
+
+type field struct {
+	id     uint16
+	length uint16
+}
+
+type template struct {
+	id     uint16
+	fields []field
+}
+
+func (t *template) recordLength() int {
+	n := 0
+	for _, f := range t.fields {
+		n += int(f.length)
+	}
+	return n
+}
+
+// encode appends the template record, in the format common to NetFlow v9
+// template flowsets and IPFIX template sets.
+func (t *template) encode(b []byte) []byte {
+	b = appendUint16(b, t.id)
+	b = appendUint16(b, uint16(len(t.fields)))
+	for _, f := range t.fields {
+		b = appendUint16(b, f.id)
+		b = appendUint16(b, f.length)
+	}
+	return b
+}
+
+func flowTemplates(ipfix bool) []*template {
+	var timeFields []field
+	if ipfix {
+		timeFields = []field{{fieldFlowStartMillis, 8}, {fieldFlowEndMillis, 8}}
+	} else {
+		timeFields = []field{{fieldFirstSwitched, 4}, {fieldLastSwitched, 4}}
+	}
+	common := []field{
+		{fieldInBytes, 8},
+		{fieldInPackets, 8},
+		{fieldProtocol, 1},
+		{fieldL4SrcPort, 2},
+		{fieldL4DstPort, 2},
+		{fieldFlowDirection, 1},
+	}
+	common = append(common, timeFields...)
+	return []*template{
+		{
+			id:     templateIDIPv4,
+			fields: append([]field{{fieldIPv4SrcAddr, 4}, {fieldIPv4DstAddr, 4}}, common...),
+		},
+		{
+			id:     templateIDIPv6,
+			fields: append([]field{{fieldIPv6SrcAddr, 16}, {fieldIPv6DstAddr, 16}}, common...),
+		},
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// record is one unidirectional flow record, as NetFlow and IPFIX have no
+// notion of bidirectional flows.
+type record struct {
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+	protocol         uint8
+	bytes, packets   uint64
+	direction        uint8
+	start, end       int64 // Unix milliseconds
+}
+
+// splitFlow returns the records for each direction of f with traffic.
+func splitFlow(f *flow.Flow) []*record {
+	var records []*record
+	start := f.Start.UnixNano() / 1e6
+	end := f.Last.UnixNano() / 1e6
+	if f.ForwardPackets > 0 {
+		r := &record{
+			srcIP: f.Key.A(), dstIP: f.Key.B(),
+			srcPort: f.Key.APort, dstPort: f.Key.BPort,
+			protocol: f.Key.Protocol,
+			bytes:    f.ForwardBytes, packets: f.ForwardPackets,
+			direction: directionIngress,
+			start:     start, end: end,
+		}
+		if f.Local {
+			r.direction = directionEgress
+		}
+		records = append(records, r)
+	}
+	if f.ReversePackets > 0 {
+		records = append(records, &record{
+			srcIP: f.Key.B(), dstIP: f.Key.A(),
+			srcPort: f.Key.BPort, dstPort: f.Key.APort,
+			protocol: f.Key.Protocol,
+			bytes:    f.ReverseBytes, packets: f.ReversePackets,
+			direction: directionIngress,
+			start:     start, end: end,
+		})
+	}
+	return records
+}
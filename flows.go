@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/interarticle/bandwidth_recorder/classify"
+	"github.com/interarticle/bandwidth_recorder/flow"
+	"github.com/interarticle/bandwidth_recorder/flowexport"
+)
+
+// flowLog is nil unless --flow_log_path is set.
+var flowLog *flow.Log
+
+func newFlowTable() (*flow.Table, error) {
+	config := flow.DefaultConfig()
+	config.IdleTimeout = *flowIdleTimeout
+	config.ActiveTimeout = *flowActiveTimeout
+	config.MaxFlows = *flowMaxEntries
+	if *flowLogPath != "" {
+		var err error
+		flowLog, err = flow.OpenLog(*flowLogPath)
+		if err != nil {
+			return nil, err
+		}
+		config.OnExpire = flowLog.Write
+	}
+	return flow.NewTable(config), nil
+}
+
+// flushFlows ends all flows, writing them to the flow log if enabled.
+func flushFlows(table *flow.Table) {
+	table.Flush()
+	if flowLog != nil {
+		flowLog.Flush()
+	}
+}
+
+// observeFlow accounts a packet of size bytes at the IP layer to its flow.
+func observeFlow(table *flow.Table, now time.Time, protocol layers.IPProtocol, srcIP, dstIP net.IP, transport gopacket.Layer, direction string, size uint64) {
+	_, srcPort, dstPort := classify.Transport(transport)
+	p := &flow.Packet{
+		Time:     now,
+		Protocol: uint8(protocol),
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+		SrcPort:  srcPort,
+		DstPort:  dstPort,
+		Bytes:    size,
+	}
+	switch direction {
+	case directionTx:
+		p.Direction = flow.DirectionOutbound
+	case directionRx:
+		p.Direction = flow.DirectionInbound
+	}
+	table.Observe(p)
+}
+
+var (
+	// exportFlows and flowExporter are nil unless --netflow_collector is
+	// set. exportFlows is separate from wanFlows since it only sees sampled
+	// packets and uses the shorter timeouts collectors expect.
+	exportFlows  *flow.Table
+	flowExporter *flowexport.Exporter
+
+	exportPacketCount uint64
+)
+
+func newFlowExport() (*flow.Table, *flowexport.Exporter, error) {
+	exporter, err := flowexport.New(flowexport.Config{
+		Collector:         *netflowCollector,
+		Version:           *netflowVersion,
+		TemplateRefresh:   *netflowTemplateRefresh,
+		SamplingInterval:  uint32(*netflowSamplingInterval),
+		ObservationDomain: uint32(*netflowObservationDomain),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	config := flow.DefaultConfig()
+	config.IdleTimeout = *netflowIdleTimeout
+	config.ActiveTimeout = *netflowActiveTimeout
+	config.MaxFlows = *flowMaxEntries
+	config.OnExpire = exporter.Export
+	return flow.NewTable(config), exporter, nil
+}
+
+// sampledForExport deterministically selects 1 in --netflow_sampling_interval
+// packets for export.
+func sampledForExport() bool {
+	if *netflowSamplingInterval <= 1 {
+		return true
+	}
+	return atomic.AddUint64(&exportPacketCount, 1)%uint64(*netflowSamplingInterval) == 0
+}
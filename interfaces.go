@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+)
+
+// All WAN and LAN metrics carry the label of the interface they account as
+// their first label.
+const interfaceLabelName = "interface"
+
+// interfaceSpec is an interface to monitor, and the value of the interface
+// label of its metrics.
+type interfaceSpec struct {
+	label  string
+	device string
+	config interfaceConfig
+}
+
+// parseInterfaces parses a comma separated list of interfaces, each a device
+// name optionally preceded by LABEL=, e.g. "fibre=eth0,lte=wwan0". The label
+// defaults to the device name.
+func parseInterfaces(spec string) ([]interfaceSpec, error) {
+	var specs []interfaceSpec
+	labels := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s := interfaceSpec{label: item, device: item}
+		if i := strings.Index(item, "="); i >= 0 {
+			s.label, s.device = item[:i], item[i+1:]
+		}
+		if s.label == "" || s.device == "" {
+			return nil, fmt.Errorf("invalid interface %q", item)
+		}
+		if labels[s.label] {
+			return nil, fmt.Errorf("duplicate interface label %q", s.label)
+		}
+		labels[s.label] = true
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// hasLabel reports whether one of specs has the interface label label.
+func hasLabel(specs []interfaceSpec, label string) bool {
+	for _, spec := range specs {
+		if spec.label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// applyInterfaceConfigs sets the configuration of each interface from
+// configs, which are keyed by interface label.
+func applyInterfaceConfigs(configs map[string]interfaceConfig, wan, lan []interfaceSpec) error {
+	used := make(map[string]bool)
+	for _, interfaces := range []struct {
+		specs []interfaceSpec
+		lan   bool
+	}{{wan, false}, {lan, true}} {
+		for i := range interfaces.specs {
+			spec := &interfaces.specs[i]
+			spec.config = configs[spec.label]
+			used[spec.label] = true
+			err := validateDirection(spec.label, spec.config, interfaces.lan)
+			if err != nil {
+				return err
+			}
+			spec.config.Capture.Filter = spec.config.Filter
+			if interfaces.lan {
+				spec.config.Capture.LinkFilter = lanIgnoreFilter
+			}
+		}
+	}
+	for label := range configs {
+		if !used[label] {
+			log.Printf("Warning: ignoring configuration of unmonitored interface %q", label)
+		}
+	}
+	return nil
+}
+
+type legacyLabeled interface {
+	SetLegacyLabels(values ...string) error
+}
+
+// migrateLegacyLabels attributes values saved before metrics had an
+// interface label to the first WAN and LAN interface respectively.
+func migrateLegacyLabels(wan, lan []interfaceSpec) error {
+	migrations := []struct {
+		interfaces []interfaceSpec
+		metrics    []legacyLabeled
+	}{
+		{wan, []legacyLabeled{
+			l2TotalBytesCounter, l3TotalBytesCounter, l4TotalBytesCounter,
+			l4TxBytesCounter, l4RxBytesCounter, l4UnknownBytesCounter,
+			l4ProtocolBytesCounter, l4ServiceBytesCounter,
+			wanL4SubnetTxBytesCounter, wanL4SubnetRxBytesCounter,
+			wanL4IPTxBytesCounter, wanL4IPRxBytesCounter,
+			wanL4PeakRateGauge, wanL4RateHistogram,
+		}},
+		{lan, []legacyLabeled{
+			lanL4TotalBytesCounter, lanL4TxBytesCounter, lanL4RxBytesCounter,
+			lanL4DeviceRxBytesCounter, lanL4DeviceTxBytesCounter,
+			lanL4ProtocolBytesCounter, lanL4ServiceBytesCounter,
+		}},
+	}
+	for _, migration := range migrations {
+		if len(migration.interfaces) == 0 {
+			continue
+		}
+		for _, metric := range migration.metrics {
+			err := metric.SetLegacyLabels(migration.interfaces[0].label)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sumInterfaces sums the values of all interfaces whose remaining labels are
+// labelValues.
+func sumInterfaces(values persistmetric.MetricValues, labelValues []string) float64 {
+	var total float64
+Values:
+	for _, value := range values {
+		if len(value.Labels) != len(labelValues)+1 {
+			continue
+		}
+		for i, labelValue := range labelValues {
+			if value.Labels[i+1] != labelValue {
+				continue Values
+			}
+		}
+		total += value.Value
+	}
+	return total
+}
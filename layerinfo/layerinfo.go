@@ -0,0 +1,165 @@
+// Package layerinfo identifies the link, network and transport layers of a
+// packet by their type rather than their position, so that encapsulation
+// such as 802.1Q tags, PPPoE or tunnels between the link and the innermost
+// IP layer is accounted separately, and raw IP links without a link layer
+// are understood.
+package layerinfo
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Breakdown describes the layers of one packet. Sizes are in bytes as on the
+// wire, so that they do not depend on how much of the packet was captured.
+type Breakdown struct {
+	// Link is the outermost layer, unless the packet starts with its
+	// network layer, as on raw IP links like ppp0 or wg0.
+	Link gopacket.Layer
+	// Encapsulations are the layers between Link and Network, such as
+	// Dot1Q, PPPoE and PPP, or the outer IP layer and GRE of a tunnel.
+	Encapsulations []gopacket.LayerType
+	// Network is the innermost IPv4 or IPv6 layer, and Transport the layer
+	// it carries past any IPv6 extension headers.
+	Network   gopacket.Layer
+	Transport gopacket.Layer
+
+	// SrcMAC and DstMAC are those of Link, if it is Ethernet.
+	SrcMAC, DstMAC net.HardwareAddr
+	// SrcIP, DstIP and Protocol are those of Network.
+	SrcIP, DstIP net.IP
+	Protocol     layers.IPProtocol
+
+	// LinkPayloadSize is the size of the packet without the header of Link.
+	LinkPayloadSize uint64
+	// EncapsulationSize is the size of the headers of Encapsulations.
+	EncapsulationSize uint64
+	// NetworkSize is the size of the packet from Network on, and
+	// NetworkPayloadSize and TransportPayloadSize the sizes of what Network
+	// and Transport carry.
+	NetworkSize          uint64
+	NetworkPayloadSize   uint64
+	TransportPayloadSize uint64
+}
+
+func isNetwork(t gopacket.LayerType) bool {
+	return t == layers.LayerTypeIPv4 || t == layers.LayerTypeIPv6
+}
+
+func isIPv6Extension(t gopacket.LayerType) bool {
+	switch t {
+	case layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Routing,
+		layers.LayerTypeIPv6Fragment, layers.LayerTypeIPv6Destination:
+		return true
+	}
+	return false
+}
+
+// nextHeader returns the protocol following an IPv6 extension header.
+func nextHeader(layer gopacket.Layer) (layers.IPProtocol, bool) {
+	switch l := layer.(type) {
+	case *layers.IPv6HopByHop:
+		return l.NextHeader, true
+	case *layers.IPv6Routing:
+		return l.NextHeader, true
+	case *layers.IPv6Fragment:
+		return l.NextHeader, true
+	case *layers.IPv6Destination:
+		return l.NextHeader, true
+	}
+	return 0, false
+}
+
+// Analyze fills b from the decoded layers of a packet of length bytes on the
+// wire, reusing its storage. decoded is in order from the outermost layer,
+// as returned by gopacket.Packet.Layers, or as assembled from the layers
+// decoded by a gopacket.DecodingLayerParser; decoding errors end it.
+func (b *Breakdown) Analyze(length int, decoded []gopacket.Layer) {
+	*b = Breakdown{Encapsulations: b.Encapsulations[:0]}
+
+	// Offsets of the layers from the start of the packet.
+	offset := uint64(0)
+	network, transport := -1, -1
+	networkOffset, transportOffset := uint64(0), uint64(0)
+	var end int
+	for end = 0; end < len(decoded); end++ {
+		layer := decoded[end]
+		if _, ok := layer.(gopacket.ErrorLayer); ok {
+			break
+		}
+		if isNetwork(layer.LayerType()) {
+			network, networkOffset = end, offset
+			transport = -1
+		} else if network >= 0 && transport < 0 && !isIPv6Extension(layer.LayerType()) {
+			transport, transportOffset = end, offset
+		}
+		offset += uint64(len(layer.LayerContents()))
+	}
+	if end == 0 {
+		return
+	}
+	size := uint64(length)
+	sizeFrom := func(offset uint64) uint64 {
+		if offset > size {
+			return 0
+		}
+		return size - offset
+	}
+
+	linkHeader := uint64(0)
+	if network != 0 {
+		b.Link = decoded[0]
+		linkHeader = uint64(len(b.Link.LayerContents()))
+		if eth, ok := b.Link.(*layers.Ethernet); ok {
+			b.SrcMAC, b.DstMAC = eth.SrcMAC, eth.DstMAC
+		}
+	}
+	b.LinkPayloadSize = sizeFrom(linkHeader)
+	if network < 0 {
+		return
+	}
+
+	if network > 0 {
+		for _, layer := range decoded[1:network] {
+			b.Encapsulations = append(b.Encapsulations, layer.LayerType())
+		}
+	}
+	b.EncapsulationSize = networkOffset - linkHeader
+	b.Network = decoded[network]
+	b.NetworkSize = sizeFrom(networkOffset)
+	switch ip := b.Network.(type) {
+	case *layers.IPv4:
+		b.SrcIP, b.DstIP, b.Protocol = ip.SrcIP, ip.DstIP, ip.Protocol
+	case *layers.IPv6:
+		b.SrcIP, b.DstIP, b.Protocol = ip.SrcIP, ip.DstIP, ip.NextHeader
+	}
+	networkEnd := end
+	if transport >= 0 {
+		networkEnd = transport
+	}
+	for _, layer := range decoded[network+1 : networkEnd] {
+		if protocol, ok := nextHeader(layer); ok {
+			b.Protocol = protocol
+		}
+	}
+	if transport < 0 {
+		b.NetworkPayloadSize = sizeFrom(offset)
+		return
+	}
+	b.NetworkPayloadSize = sizeFrom(transportOffset)
+	b.Transport = decoded[transport]
+	b.TransportPayloadSize = sizeFrom(transportOffset + uint64(len(b.Transport.LayerContents())))
+}
+
+// EncapsulationName names the encapsulation of the packet by its layers,
+// e.g. "PPPoE/PPP", or is empty if there is none.
+func (b *Breakdown) EncapsulationName() string {
+	names := make([]string, len(b.Encapsulations))
+	for i, t := range b.Encapsulations {
+		names[i] = t.String()
+	}
+	return strings.Join(names, "/")
+}
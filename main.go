@@ -4,31 +4,73 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/interarticle/bandwidth_recorder/classify"
+	"github.com/interarticle/bandwidth_recorder/flow"
+	"github.com/interarticle/bandwidth_recorder/layerinfo"
+	"github.com/interarticle/bandwidth_recorder/packetsource"
 	"github.com/interarticle/bandwidth_recorder/persistmetric"
+	"github.com/interarticle/bandwidth_recorder/quota"
+	"github.com/interarticle/bandwidth_recorder/window"
 )
 
 var (
-	wanDevice    = flag.String("wan_device", "eth0", "Name of the WAN (Internet) device to monitor.")
-	lanDevice    = flag.String("lan_device", "", "Name of the LAN device to monitor; This is only enabled if set.")
+	wanDevice = flag.String("wan_device", "eth0", "Comma-separated WAN (Internet) devices to monitor, each optionally preceded by LABEL= to set its interface label, e.g. \"fibre=eth0,lte=wwan0\". "+
+		"Values saved before metrics had an interface label are attributed to the first.")
+	lanDevice    = flag.String("lan_device", "", "Comma-separated LAN devices to monitor, in the same form as --wan_device; This is only enabled if set.")
 	listenSpec   = flag.String("listen_spec", "", "Host and port on which to provide Prometheus monitoring.")
 	databasePath = flag.String("database_path", "", "Path to the database used to store persistent metrics.")
-)
+	configPath   = flag.String("config", "", "Path to a JSON configuration file for quotas and other optional features.")
+	windowSpecs  = flag.String("windows", "month", "Comma-separated windows over which persistent metrics accumulate, e.g. \"month,billing(17)@America/New_York,day,hour\". "+
+		"Kinds are month, billing(DAY), day, week, hour and cron(EXPR); prefix with NAME= to rename.")
+	retentionSpec = flag.String("retention", "", "Comma-separated tiers of windows whose past periods are archived rather than deleted, finest first, each optionally followed by :DURATION to keep it, e.g. \"hour:7d,day:90d,month\". "+
+		"Expired periods are rolled up into the next tier; history is served at /history. Disabled if empty.")
+	deviceRefreshInterval    = flag.Duration("device_refresh_interval", time.Minute, "How often friendly names of LAN devices are re-read.")
+	deviceForgetAfter        = flag.Duration("device_forget_after", 24*time.Hour, "How long a LAN device keeps its name after disappearing from all name sources.")
+	quotaCheckInterval       = flag.Duration("quota_check_interval", 30*time.Second, "How often quotas are evaluated.")
+	flowTracking             = flag.Bool("flow_tracking", false, "Whether to track WAN flows, serving the top flows and remote hosts at /flows and /hosts.")
+	flowIdleTimeout          = flag.Duration("flow_idle_timeout", time.Minute, "How long a flow may go without packets before it ends.")
+	flowActiveTimeout        = flag.Duration("flow_active_timeout", 30*time.Minute, "How long a flow may last before it is ended and a new one started.")
+	flowMaxEntries           = flag.Int("flow_max_entries", 65536, "Maximum number of flows tracked; the least recently active flow is evicted beyond this.")
+	flowLogPath              = flag.String("flow_log_path", "", "Path to a file to which ended flows are appended as JSON lines; disabled if empty.")
+	netflowCollector         = flag.String("netflow_collector", "", "Host and port of a NetFlow v9 or IPFIX collector to export WAN flows to over UDP; disabled if empty.")
+	netflowVersion           = flag.Int("netflow_version", 9, "Flow export protocol: 9 for NetFlow v9, or 10 for IPFIX.")
+	netflowTemplateRefresh   = flag.Duration("netflow_template_refresh", time.Minute, "How often templates are resent to the flow collector.")
+	netflowSamplingInterval  = flag.Int("netflow_sampling_interval", 1, "Export flows of 1 in this many packets.")
+	netflowObservationDomain = flag.Int("netflow_observation_domain", 0, "NetFlow v9 source ID or IPFIX observation domain ID.")
+	netflowIdleTimeout       = flag.Duration("netflow_idle_timeout", 15*time.Second, "How long an exported flow may go without packets before it is sent.")
+	netflowActiveTimeout     = flag.Duration("netflow_active_timeout", time.Minute, "How often long-lived flows are sent to the flow collector.")
+	wanPerIPAccounting       = flag.Bool("wan_per_ip_accounting", false, "Whether to account WAN traffic per local IP address within the wan_subnets of --config, in addition to per subnet.")
+	recordPathPrefix         = flag.String("record_path_prefix", "", "Path prefix of files to which the metadata of every WAN packet is recorded for bandwidth_stats, e.g. /var/lib/bandwidth_recorder/wan; disabled if empty.")
+	recordRotateSize         = flag.Int64("record_rotate_size", 1<<30, "Size in bytes at which a new recording file is started; 0 disables size based rotation.")
+	recordRotateInterval     = flag.Duration("record_rotate_interval", 24*time.Hour, "How long a recording file is written before a new one is started; 0 disables time based rotation.")
+	recordFormat             = flag.String("record_format", "gob", "Format of recording files: gob, or columnar for faster analysis by bandwidth_stats.")
+	recordCompress           = flag.Bool("record_compress", false, "Whether to compress recording files: gob files are gzipped, while columnar files compress each chunk.")
+	burstBillingWindow       = flag.String("burst_billing_window", "", "Billing cycle of 95th percentile billing of the WAN device, as a window specification, e.g. \"billing(17)\"; disabled if empty. Report closed cycles with burst_report.")
+	burstBillingMode         = flag.String("burst_billing_mode", "max", "How directions are combined for 95th percentile billing: max bills the higher of the percentiles of Tx and Rx, sum the percentile of their sum.")
+	burstBillingInterface    = flag.String("burst_billing_interface", "", "Label of the WAN interface billed at the 95th percentile; defaults to the first.")
+	burstBillingInterval     = flag.Duration("burst_billing_sample_interval", 5*time.Minute, "Interval over which throughput is sampled for 95th percentile billing.")
+	recordIndexInterval      = flag.Duration("record_index_interval", time.Minute, "Granularity of the index written alongside each gob recording file, which lets bandwidth_stats seek to a time range; 0 disables the index.")
 
-const (
-	monthDateFormat = "2006-01"
+	replayPcap    = flag.String("replay_pcap", "", "Comma-separated paths to pcap or pcapng captures of the WAN devices to replay instead of capturing live, in the order of --wan_device.")
+	replayLanPcap = flag.String("replay_lan_pcap", "", "Comma-separated paths to pcap or pcapng captures of the LAN devices to replay along with --replay_pcap, in the order of --lan_device.")
+	replayWanMAC  = flag.String("replay_wan_mac", "", "Comma-separated hardware addresses of the WAN devices the replayed captures were taken on; default to those of --wan_device.")
+	replayLanMAC  = flag.String("replay_lan_mac", "", "Comma-separated hardware addresses of the LAN devices the replayed captures were taken on; default to those of --lan_device.")
 )
 
 func getIPAddresses(intf *net.Interface) ([]net.IP, error) {
@@ -45,21 +87,85 @@ func getIPAddresses(intf *net.Interface) ([]net.IP, error) {
 	return outAddrs, nil
 }
 
-func wanMonitoringWorker() error {
+// monitoredDevice describes the interface whose traffic a worker accounts.
+type monitoredDevice struct {
+	name string
+	// label is the value of the interface label of its metrics.
+	label        string
+	config       interfaceConfig
+	hardwareAddr net.HardwareAddr
+	// intf is nil when replaying a capture taken on another host.
+	intf *net.Interface
+}
+
+// lookupDevice resolves the device of spec. If macOverride is set, it is
+// used as the hardware address instead, and the interface need not exist.
+func lookupDevice(spec interfaceSpec, macOverride string) (*monitoredDevice, error) {
+	name := spec.device
+	dev := &monitoredDevice{name: name, label: spec.label, config: spec.config}
+	if intf, err := net.InterfaceByName(name); err == nil {
+		dev.intf = intf
+		dev.hardwareAddr = intf.HardwareAddr
+	} else if macOverride == "" {
+		return nil, err
+	}
+	if macOverride != "" {
+		addr, err := net.ParseMAC(macOverride)
+		if err != nil {
+			return nil, err
+		}
+		dev.hardwareAddr = addr
+	}
+	return dev, nil
+}
+
+func (d *monitoredDevice) String() string {
+	if d.intf != nil {
+		return fmt.Sprintf("%s: %v", d.label, d.intf)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.label, d.name, d.hardwareAddr)
+}
+
+// wanSubnets is nil unless subnets are configured.
+var wanSubnets *subnetAccounting
+
+// wanFlows is nil unless --flow_tracking is set.
+var wanFlows *flow.Table
+
+// readSources runs read on each of srcs concurrently, returning the first
+// error.
+func readSources(srcs []packetsource.Source, read func(src packetsource.Source) error) error {
+	if len(srcs) == 1 {
+		return read(srcs[0])
+	}
+	errs := make(chan error, len(srcs))
+	for _, src := range srcs {
+		go func(src packetsource.Source) {
+			errs <- read(src)
+		}(src)
+	}
+	for range srcs {
+		err := <-errs
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wanMonitoringWorker accounts the traffic of dev read from srcs, which are
+// read concurrently and accounted together.
+func wanMonitoringWorker(dev *monitoredDevice, srcs ...packetsource.Source) error {
 	startTime := time.Now()
-	jobBaseLabel := prometheus.Labels{"job_start_time": startTime.Format(time.RFC3339)}
+	jobBaseLabel := prometheus.Labels{"job_start_time": startTime.Format(time.RFC3339), interfaceLabelName: dev.label}
 	gauge := wanTotalBytesGauge.With(jobBaseLabel)
 
-	intf, err := net.InterfaceByName(*wanDevice)
-	if err != nil {
-		return err
-	}
-	log.Printf("Starting bandwidth monitoring on wanDevice %v", intf)
-	handle, err := pcap.OpenLive(*wanDevice, 500, false, pcap.BlockForever)
+	log.Printf("Starting bandwidth monitoring on wanDevice %v", dev)
+	live := srcs[0].Live()
+	classifier, err := newDirectionClassifier(dev, live, false)
 	if err != nil {
 		return err
 	}
-	packets := gopacket.NewPacketSource(handle, handle.LinkType())
 	var layer2PlusTotal uint64
 	var layer2PlusDelta uint64
 	var layer3PlusDelta uint64
@@ -67,61 +173,154 @@ func wanMonitoringWorker() error {
 	var layer4TxDelta uint64
 	var layer4RxDelta uint64
 	var layer4UnknownDelta uint64
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			gauge.Set(float64(atomic.LoadUint64(&layer2PlusTotal)))
-			datetimeString := time.Now().Format(monthDateFormat)
-			l2TotalBytesCounter.Add(datetimeString, float64(atomic.SwapUint64(&layer2PlusDelta, 0)))
-			l3TotalBytesCounter.Add(datetimeString, float64(atomic.SwapUint64(&layer3PlusDelta, 0)))
-			l4TotalBytesCounter.Add(datetimeString, float64(atomic.SwapUint64(&layer4PlusDelta, 0)))
-			l4TxBytesCounter.Add(datetimeString, float64(atomic.SwapUint64(&layer4TxDelta, 0)))
-			l4RxBytesCounter.Add(datetimeString, float64(atomic.SwapUint64(&layer4RxDelta, 0)))
-			l4UnknownBytesCounter.Add(datetimeString, float64(atomic.SwapUint64(&layer4UnknownDelta, 0)))
+	breakdown := &protocolBreakdown{
+		iface:           dev.label,
+		protocolCounter: l4ProtocolBytesCounter,
+		serviceCounter:  l4ServiceBytesCounter,
+	}
+	var encapsulations labeledDeltas
+	rates := &rateTracker{iface: dev.label}
+	billing := burstBilling
+	if dev.label != burstBillingLabel {
+		billing = nil
+	}
+	flush := func(now time.Time) {
+		gauge.Set(float64(atomic.LoadUint64(&layer2PlusTotal)))
+		l2TotalBytesCounter.WithLabelValues(dev.label).AddAt(now, float64(atomic.SwapUint64(&layer2PlusDelta, 0)))
+		l3TotalBytesCounter.WithLabelValues(dev.label).AddAt(now, float64(atomic.SwapUint64(&layer3PlusDelta, 0)))
+		l4TotalBytesCounter.WithLabelValues(dev.label).AddAt(now, float64(atomic.SwapUint64(&layer4PlusDelta, 0)))
+		txDelta := atomic.SwapUint64(&layer4TxDelta, 0)
+		rxDelta := atomic.SwapUint64(&layer4RxDelta, 0)
+		l4TxBytesCounter.WithLabelValues(dev.label).AddAt(now, float64(txDelta))
+		l4RxBytesCounter.WithLabelValues(dev.label).AddAt(now, float64(rxDelta))
+		l4UnknownBytesCounter.WithLabelValues(dev.label).AddAt(now, float64(atomic.SwapUint64(&layer4UnknownDelta, 0)))
+		breakdown.flush(now)
+		encapsulations.flush(encapOverheadBytesCounter, now)
+		rates.observe(now, txDelta, rxDelta)
+		if billing != nil {
+			err := billing.Add(now, txDelta, rxDelta)
+			if err != nil {
+				log.Printf("Warning: failed to save burst billing sample: %v", err)
+			}
 		}
-	}()
-PacketLoop:
-	for {
-		packet, err := packets.NextPacket()
-		if err != nil {
-			return err
+		if wanSubnets != nil {
+			wanSubnets.flush(now)
 		}
-		remainingSize := uint64(packet.Metadata().Length)
-		var srcMAC, dstMAC *net.HardwareAddr
-		for i, layer := range packet.Layers() {
-			if _, ok := layer.(gopacket.ErrorLayer); ok {
-				break // Stop at error layer.
+	}
+	if live {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+				flush(time.Now())
 			}
-			switch i {
-			case 0:
-				remainingSize -= uint64(len(layer.LayerContents()))
-				atomic.AddUint64(&layer2PlusTotal, remainingSize)
-				atomic.AddUint64(&layer2PlusDelta, remainingSize)
-
-				if eth, ok := layer.(*layers.Ethernet); ok {
-					srcMAC = &eth.SrcMAC
-					dstMAC = &eth.DstMAC
+		}()
+	}
+	return readSources(srcs, func(src packetsource.Source) error {
+		var lastPacketTime time.Time
+		var b layerinfo.Breakdown
+		for {
+			packet, err := src.NextPacket()
+			if err == io.EOF && !src.Live() {
+				// Nothing is flushed for captures without packets.
+				if !lastPacketTime.IsZero() {
+					flush(lastPacketTime)
 				}
-			case 1:
-				remainingSize -= uint64(len(layer.LayerContents()))
-				atomic.AddUint64(&layer3PlusDelta, remainingSize)
-			case 2:
-				remainingSize -= uint64(len(layer.LayerContents()))
-				atomic.AddUint64(&layer4PlusDelta, remainingSize)
-
-				switch {
-				case srcMAC != nil && bytes.Equal(*srcMAC, intf.HardwareAddr):
-					atomic.AddUint64(&layer4TxDelta, remainingSize)
-				case dstMAC != nil && bytes.Equal(*dstMAC, intf.HardwareAddr):
-					atomic.AddUint64(&layer4RxDelta, remainingSize)
-				default:
-					atomic.AddUint64(&layer4UnknownDelta, remainingSize)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			recordPacket(packet)
+			if !src.Live() {
+				// Replayed packets are flushed once per second of capture time.
+				packetTime := packet.Metadata().Timestamp
+				if !lastPacketTime.IsZero() && packetTime.Truncate(time.Second) != lastPacketTime.Truncate(time.Second) {
+					flush(lastPacketTime)
 				}
+				lastPacketTime = packetTime
+			}
+			b.Analyze(packet.Metadata().Length, packet.Layers())
+			if b.Link == nil && b.Network == nil {
+				continue
+			}
+			atomic.AddUint64(&layer2PlusTotal, b.LinkPayloadSize)
+			atomic.AddUint64(&layer2PlusDelta, b.LinkPayloadSize)
+			if b.EncapsulationSize > 0 {
+				encapsulations.add(b.EncapsulationSize, dev.label, b.EncapsulationName())
+			}
+			if b.Network == nil {
+				continue
+			}
+			atomic.AddUint64(&layer3PlusDelta, b.NetworkPayloadSize)
+			if b.Transport == nil {
+				continue
+			}
+			size := b.TransportPayloadSize
+			atomic.AddUint64(&layer4PlusDelta, size)
+			if wanSubnets != nil {
+				wanSubnets.observe(dev.label, b.SrcIP, b.DstIP, size)
+			}
+
+			direction := directionUnknown
+			switch classifier.classify(packet, &b) {
+			case packetsource.DirectionOut:
+				atomic.AddUint64(&layer4TxDelta, size)
+				direction = directionTx
+			case packetsource.DirectionIn:
+				atomic.AddUint64(&layer4RxDelta, size)
+				direction = directionRx
 			default:
-				continue PacketLoop // Stop at the first unmatched layer.
+				atomic.AddUint64(&layer4UnknownDelta, size)
+			}
+			breakdown.observe(b.Transport, direction, size)
+			if wanFlows != nil {
+				observeFlow(wanFlows, packetsource.PacketTime(src, packet), b.Protocol,
+					b.SrcIP, b.DstIP, b.Transport, direction, b.NetworkSize)
+			}
+			if exportFlows != nil && sampledForExport() {
+				observeFlow(exportFlows, packetsource.PacketTime(src, packet), b.Protocol,
+					b.SrcIP, b.DstIP, b.Transport, direction, b.NetworkSize)
 			}
 		}
+	})
+}
+
+// monitorLive runs worker on the live traffic of the device of spec, exiting
+// if it fails.
+func monitorLive(spec interfaceSpec, worker func(*monitoredDevice, ...packetsource.Source) error) {
+	dev, err := lookupDevice(spec, "")
+	if err != nil {
+		fatal(err)
+	}
+	var srcs []packetsource.Source
+	if spec.config.Direction == directionByPcap {
+		var src packetsource.Source
+		src, err = packetsource.OpenLiveDirectional(spec.device, spec.config.Capture)
+		srcs = []packetsource.Source{src}
+	} else {
+		srcs, err = packetsource.OpenFanout(spec.device, spec.config.Capture)
 	}
+	if err != nil {
+		fatal(err)
+	}
+	err = worker(dev, srcs...)
+	fatal(err)
+}
+
+// fatal saves what would otherwise be lost on exit, then logs v and exits.
+func fatal(v ...interface{}) {
+	flushBurstBilling()
+	log.Fatal(v...)
+}
+
+// exitOnSignal saves what would otherwise be lost, like fatal, once the
+// recorder is stopped by SIGINT or SIGTERM.
+func exitOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Exiting on %v", <-signals)
+	flushBurstBilling()
+	os.Exit(0)
 }
 
 func mustParseMAC(s string) net.HardwareAddr {
@@ -160,163 +359,155 @@ var ignoreLANMACRanges = []macMatch{
 	macMatch{mustParseMAC("01:00:00:00:00:00"), mustParseMAC("01:00:00:00:00:00")},
 }
 
-func lanMonitoringWorker() error {
-	intf, err := net.InterfaceByName(*lanDevice)
+// lanIgnoreFilter returns a BPF filter expression dropping the packets the
+// LAN worker ignores by address, so that they are dropped in the kernel.
+// The worker still checks them itself for sources without filters.
+func lanIgnoreFilter(linkType layers.LinkType) string {
+	if linkType == layers.LinkTypeEthernet {
+		return "not ether multicast" // Matches ignoreLANMACRanges.
+	}
+	return "not ip multicast and not ip6 multicast and not dst host 255.255.255.255"
+}
+
+// lanMonitoringWorker accounts the traffic of dev read from srcs, which are
+// read concurrently.
+func lanMonitoringWorker(dev *monitoredDevice, srcs ...packetsource.Source) error {
+	log.Printf("Starting bandwidth monitoring on lanDevice %v", dev)
+	live := srcs[0].Live()
+	localAddresses, err := watchLocalAddresses(dev, live, getIPAddresses)
 	if err != nil {
 		return err
 	}
-	log.Printf("Starting bandwidth monitoring on lanDevice %v", intf)
-	handle, err := pcap.OpenLive(*lanDevice, 500, false, pcap.BlockForever)
+	classifier, err := newDirectionClassifier(dev, live, true)
 	if err != nil {
 		return err
 	}
-	packets := gopacket.NewPacketSource(handle, handle.LinkType())
-	var localAddresses atomic.Value // []net.IP
-	{
-		localIPs, err := getIPAddresses(intf)
-		if err != nil {
-			return err
-		}
-		localAddresses.Store(localIPs)
-	}
-	go func() {
-		for {
-			time.Sleep(time.Second)
+	return readSources(srcs, func(src packetsource.Source) error {
+		return readLAN(dev, src, localAddresses, classifier)
+	})
+}
 
-			localIPs, err := getIPAddresses(intf)
-			if err != nil {
-				log.Fatalf("Failed to update LAN IP addresses: %v", err)
-			}
-			localAddresses.Store(localIPs)
-		}
-	}()
+// readLAN accounts the traffic of dev read from src.
+func readLAN(dev *monitoredDevice, src packetsource.Source, localAddresses *atomic.Value, classifier *directionClassifier) error {
+	var b layerinfo.Breakdown
 PacketLoop:
 	for {
-		packet, err := packets.NextPacket()
+		packet, err := src.NextPacket()
+		if err == io.EOF && !src.Live() {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		remainingSize := uint64(packet.Metadata().Length)
-		var srcMAC, dstMAC net.HardwareAddr
-		var srcIP, dstIP net.IP
-		for i, layer := range packet.Layers() {
-			if _, ok := layer.(gopacket.ErrorLayer); ok {
-				break // Stop at error layer.
-			}
-			switch i {
-			case 0:
-				remainingSize -= uint64(len(layer.LayerContents()))
-
-				if eth, ok := layer.(*layers.Ethernet); ok {
-					srcMAC = eth.SrcMAC
-					dstMAC = eth.DstMAC
-					for _, mMatch := range ignoreLANMACRanges {
-						if mMatch.Match(srcMAC) || mMatch.Match(dstMAC) {
-							continue PacketLoop // Drop ignored ranges early.
-						}
-					}
-					if !bytes.Equal(srcMAC, intf.HardwareAddr) &&
-						!bytes.Equal(dstMAC, intf.HardwareAddr) {
-						continue PacketLoop
-					}
-				} else {
-					continue PacketLoop // LAN without MAC should be ignored.
-				}
-			case 1:
-				remainingSize -= uint64(len(layer.LayerContents()))
-
-				if ip, ok := layer.(*layers.IPv4); ok {
-					srcIP = ip.SrcIP
-					dstIP = ip.DstIP
-				} else if ip, ok := layer.(*layers.IPv6); ok {
-					srcIP = ip.SrcIP
-					dstIP = ip.DstIP
-				} else {
-					continue PacketLoop // LAN without IP should be ignored.
-				}
-				for _, ip := range localAddresses.Load().([]net.IP) {
-					if ip.Equal(srcIP) || ip.Equal(dstIP) {
-						continue PacketLoop // Packets explicitly sent to or from the router should be dropped.
-					}
-				}
-			case 2:
-				remainingSize -= uint64(len(layer.LayerContents()))
-				datetimeString := time.Now().Format(monthDateFormat)
-
-				switch {
-				case bytes.Equal(srcMAC, intf.HardwareAddr):
-					lanL4TxBytesCounter.Add(datetimeString, float64(remainingSize))
-					lanL4DeviceTxBytesCounter.WithLabelValues(dstMAC.String()).Add(datetimeString, float64(remainingSize))
-				case bytes.Equal(dstMAC, intf.HardwareAddr):
-					lanL4RxBytesCounter.Add(datetimeString, float64(remainingSize))
-					lanL4DeviceRxBytesCounter.WithLabelValues(srcMAC.String()).Add(datetimeString, float64(remainingSize))
-				default:
-					panic("should not be reached")
+		b.Analyze(packet.Metadata().Length, packet.Layers())
+		if b.Network == nil {
+			continue // LAN without IP should be ignored.
+		}
+		if _, ok := b.Link.(*layers.Ethernet); ok {
+			for _, mMatch := range ignoreLANMACRanges {
+				if mMatch.Match(b.SrcMAC) || mMatch.Match(b.DstMAC) {
+					continue PacketLoop // Drop ignored ranges early.
 				}
-				lanL4TotalBytesCounter.Add(datetimeString, float64(remainingSize))
-			default:
-				continue PacketLoop // Stop at the first unmatched layer.
 			}
+		} else if b.DstIP.IsMulticast() || b.DstIP.Equal(net.IPv4bcast) {
+			continue // Without MAC addresses, drop multicast by IP.
+		}
+		for _, ip := range localAddresses.Load().([]net.IP) {
+			if ip.Equal(b.SrcIP) || ip.Equal(b.DstIP) {
+				continue PacketLoop // Packets explicitly sent to or from the router should be dropped.
+			}
+		}
+		if b.Transport == nil {
+			continue
 		}
+		// Devices are identified by MAC address, or by IP address on
+		// interfaces without MAC addresses.
+		srcPeer, dstPeer := peers(&b)
+		size := float64(b.TransportPayloadSize)
+		now := packetsource.PacketTime(src, packet)
+
+		var direction string
+		switch classifier.classify(packet, &b) {
+		case packetsource.DirectionOut:
+			lanL4TxBytesCounter.WithLabelValues(dev.label).AddAt(now, size)
+			lanL4DeviceTxBytesCounter.WithLabelValues(dev.label, dstPeer).AddAt(now, size)
+			direction = directionTx
+		case packetsource.DirectionIn:
+			lanL4RxBytesCounter.WithLabelValues(dev.label).AddAt(now, size)
+			lanL4DeviceRxBytesCounter.WithLabelValues(dev.label, srcPeer).AddAt(now, size)
+			direction = directionRx
+		default:
+			continue // Not forwarded by this host.
+		}
+		lanL4TotalBytesCounter.WithLabelValues(dev.label).AddAt(now, size)
+
+		protocol, srcPort, dstPort := classify.Transport(b.Transport)
+		lanL4ProtocolBytesCounter.WithLabelValues(dev.label, protocol, direction).AddAt(now, size)
+		lanL4ServiceBytesCounter.WithLabelValues(dev.label, services.Service(protocol, srcPort, dstPort), direction).AddAt(now, size)
 	}
 }
 
 var (
-	persistStorage     = persistmetric.MustNew()
+	persistStorage     = persistmetric.MustNew(persistmetric.Windows(window.CalendarMonth(time.Local)))
 	wanTotalBytesGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "wan_total_bytes",
 			Help: "Total number of bytes sent and received from the Internet as recorded by this recorder job instance",
 		}, []string{
 			"job_start_time",
+			interfaceLabelName,
 		})
 	l2TotalBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "l2_total_bytes",
 		Help: "Total number of bytes sent and received from the Internet on Layer 2",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	l3TotalBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "l3_total_bytes",
 		Help: "Total number of bytes sent and received from the Internet on Layer 3",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	l4TotalBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "l4_total_bytes",
 		Help: "Total number of bytes sent and received from the Internet on Layer 4",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	l4TxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "l4_tx_bytes",
 		Help: "Number of bytes sent to the Internet on Layer 4",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	l4RxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "l4_rx_bytes",
 		Help: "Number of bytes received from the Internet on Layer 4",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	l4UnknownBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "l4_unknown_bytes",
 		Help: "Number of bytes transmitted on the Internet interface which cannot be classified under Tx or Rx",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
+	encapOverheadBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "encap_overhead_bytes",
+		Help: "Number of bytes of encapsulation headers, such as VLAN tags, PPPoE or tunnels, on the Internet interface",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "encapsulation"}))
 )
 
 var (
 	lanL4TotalBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "lan_l4_total_bytes",
 		Help: "Number of bytes sent/received on the LAN interface",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	lanL4TxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "lan_l4_tx_bytes",
 		Help: "Number of bytes sent to the LAN interface",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	lanL4RxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "lan_l4_rx_bytes",
 		Help: "Number of bytes received from the LAN interface",
-	})
+	}, persistmetric.VariableLabels([]string{interfaceLabelName}))
 	lanL4DeviceRxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "lan_l4_device_rx_bytes",
 		Help: "Number of bytes received from a specific device on the LAN interface",
-	}, persistmetric.VariableLabels([]string{"mac_address"}))
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "mac_address"}))
 	lanL4DeviceTxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
 		Name: "lan_l4_device_tx_bytes",
 		Help: "Number of bytes sent to a specific device on the LAN interface",
-	}, persistmetric.VariableLabels([]string{"mac_address"}))
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "mac_address"}))
 )
 
 func init() {
@@ -327,6 +518,7 @@ func init() {
 	prometheus.MustRegister(l4RxBytesCounter)
 	prometheus.MustRegister(l4TxBytesCounter)
 	prometheus.MustRegister(l4UnknownBytesCounter)
+	prometheus.MustRegister(encapOverheadBytesCounter)
 }
 
 func initLan() {
@@ -339,28 +531,156 @@ func initLan() {
 
 func main() {
 	flag.Parse()
-	if *lanDevice != "" {
+	wanInterfaces, err := parseInterfaces(*wanDevice)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(wanInterfaces) == 0 {
+		log.Fatal("you must specify at least one --wan_device")
+	}
+	lanInterfaces, err := parseInterfaces(*lanDevice)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(lanInterfaces) > 0 || *replayLanPcap != "" {
 		initLan()
+		initLanBreakdown()
+	}
+	err = migrateLegacyLabels(wanInterfaces, lanInterfaces)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = applyInterfaceConfigs(config.Interfaces, wanInterfaces, lanInterfaces)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(config.Services) > 0 {
+		services, err = classify.NewClassifier(append(config.Services, classify.DefaultServices...))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	windows, err := window.ParseList(*windowSpecs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotaEngine := quota.NewEngine(persistStorage)
+	windows, err = setupQuotas(config, quotaEngine, windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deviceGroups, windows, err := setupDeviceGroups(config, quotaEngine, windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *flowTracking {
+		wanFlows, err = newFlowTable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		http.Handle("/flows", flow.TopFlowsHandler(wanFlows))
+		http.Handle("/hosts", flow.TopHostsHandler(wanFlows))
+	}
+	if *netflowCollector != "" {
+		exportFlows, flowExporter, err = newFlowExport()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(config.WANSubnets) > 0 {
+		wanSubnets, err = newSubnetAccounting(config.WANSubnets, *wanPerIPAccounting)
+		if err != nil {
+			log.Fatal(err)
+		}
+		initSubnets(*wanPerIPAccounting)
+	}
+	if *burstBillingWindow != "" {
+		burstBilling, err = newBurstBilling()
+		if err != nil {
+			log.Fatal(err)
+		}
+		burstBillingLabel = wanInterfaces[0].label
+		if *burstBillingInterface != "" {
+			burstBillingLabel = *burstBillingInterface
+		}
+		if !hasLabel(wanInterfaces, burstBillingLabel) {
+			log.Fatalf("--burst_billing_interface %q is not the label of a WAN interface", burstBillingLabel)
+		}
+	}
+	if *recordPathPrefix != "" {
+		wanRecorder, err = newRecorder()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = persistStorage.SetWindows(windows...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *retentionSpec != "" {
+		tiers, err := persistmetric.ParseRetention(*retentionSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = persistStorage.SetRetention(tiers...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replayPcap != "" {
+		replayMain(wanInterfaces, lanInterfaces)
+		return
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/history", persistmetric.HistoryHandler(persistStorage))
+	if len(lanInterfaces) > 0 {
+		resolver, err := newDeviceResolver(config.DeviceNames, *deviceForgetAfter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(resolver)
+		go resolver.Run(*deviceRefreshInterval, nil)
+		http.Handle("/devices", deviceReportHandler(windows, deviceGroups, resolver))
+	}
 
-	err := persistStorage.Initialize(context.Background(), *databasePath)
+	err = persistStorage.Initialize(context.Background(), *databasePath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go func() {
-		err := wanMonitoringWorker()
-		log.Fatal(err)
-	}()
-
-	go func() {
-		if *lanDevice != "" {
-			err := lanMonitoringWorker()
+	if burstBilling != nil {
+		err = burstBilling.Load(time.Now())
+		if err != nil {
 			log.Fatal(err)
 		}
-	}()
+	}
+	if len(quotaEngine.Quotas()) > 0 {
+		prometheus.MustRegister(quotaEngine)
+		go quotaEngine.Run(*quotaCheckInterval, nil)
+	}
+	if wanFlows != nil {
+		go wanFlows.Run(time.Second, nil)
+	}
+	if exportFlows != nil {
+		go exportFlows.Run(time.Second, nil)
+		go flowExporter.Run(time.Second, nil)
+	}
+	if wanRecorder != nil {
+		go flushRecording(5 * time.Second)
+	}
+
+	go exitOnSignal()
+	for _, spec := range wanInterfaces {
+		go monitorLive(spec, wanMonitoringWorker)
+	}
+	for _, spec := range lanInterfaces {
+		go monitorLive(spec, lanMonitoringWorker)
+	}
 
-	log.Fatal(http.ListenAndServe(*listenSpec, nil))
+	fatal(http.ListenAndServe(*listenSpec, nil))
 }
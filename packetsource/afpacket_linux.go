@@ -0,0 +1,251 @@
+package packetsource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// Hardware types of network devices, from linux/if_arp.h.
+const (
+	arphrdEther    = 1
+	arphrdPPP      = 512
+	arphrdRawIP    = 519
+	arphrdLoopback = 772
+	arphrdNone     = 65534
+)
+
+// afpacketSnapLen is the capture length filters are compiled for, as
+// AF_PACKET captures whole packets.
+const afpacketSnapLen = 65535
+
+// deviceLinkType returns the link type of packets read from the named device
+// by a raw AF_PACKET socket.
+func deviceLinkType(device string) (layers.LinkType, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", device, "type"))
+	if err != nil {
+		return 0, err
+	}
+	hardwareType, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, err
+	}
+	switch hardwareType {
+	case arphrdEther, arphrdLoopback:
+		return layers.LinkTypeEthernet, nil
+	case arphrdPPP, arphrdRawIP, arphrdNone:
+		// These devices have no link layer header.
+		return layers.LinkTypeRaw, nil
+	}
+	return 0, fmt.Errorf("device %s has unsupported hardware type %d", device, hardwareType)
+}
+
+// afpacketPollTimeout bounds how long a read waits for packets before
+// checking whether the source was closed.
+const afpacketPollTimeout = 100 * time.Millisecond
+
+// nextFanoutGroup is the next fanout group id tried. Groups are shared by
+// all sockets of the host, so ids start from one particular to this process.
+var nextFanoutGroup = uint32(os.Getpid())
+
+// joinFanoutGroup joins tpacket to a new fanout group and returns its id.
+func joinFanoutGroup(tpacket *afpacket.TPacket) (uint16, error) {
+	var err error
+	for attempt := 0; attempt < 16; attempt++ {
+		id := uint16(atomic.AddUint32(&nextFanoutGroup, 1))
+		err = tpacket.SetFanout(afpacket.FanoutHash, id)
+		if err == nil {
+			return id, nil
+		}
+		// EEXIST and EINVAL are returned if the group is used by other
+		// sockets with other settings.
+		if err != syscall.EEXIST && err != syscall.EINVAL {
+			return 0, err
+		}
+	}
+	return 0, err
+}
+
+// afpacketSource reads packets from an AF_PACKET TPACKET_V3 ring buffer. As
+// packets are decoded in place in the ring, each is only valid until the
+// next call to NextPacket.
+type afpacketSource struct {
+	linkType layers.LinkType
+	parser   *layerParser
+
+	// mu is held while reading, so that Close does not unmap the ring
+	// under a read. closing is set first so that reads stop waiting.
+	mu      sync.Mutex
+	tpacket *afpacket.TPacket
+	closing int32
+
+	// filteredSince is when the filter was set, if any. Packets captured
+	// before are dropped, as the ring may already hold some.
+	filteredSince time.Time
+}
+
+// openAFPacket opens opts.Fanout sockets, or one, on the named device.
+// Sockets of a fanout group each receive a share of the packets by flow.
+func openAFPacket(device string, opts CaptureOptions) ([]Source, error) {
+	if opts.Promiscuous {
+		return nil, fmt.Errorf("the %s backend does not support promiscuous mode", BackendAFPacket)
+	}
+	if opts.SnapLen != 0 {
+		return nil, fmt.Errorf("the %s backend does not support snaplen", BackendAFPacket)
+	}
+	linkType, err := deviceLinkType(device)
+	if err != nil {
+		return nil, err
+	}
+	var filter []bpf.RawInstruction
+	if expr := opts.FilterFor(linkType); expr != "" {
+		filter, err = compileAFPacketFilter(linkType, expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tpacketOpts := []interface{}{
+		afpacket.OptInterface(device),
+		afpacket.TPacketVersion3,
+		afpacket.OptPollTimeout(afpacketPollTimeout),
+	}
+	if opts.BufferSize > 0 {
+		numBlocks := opts.BufferSize / afpacket.DefaultBlockSize
+		if numBlocks < 1 {
+			numBlocks = 1
+		}
+		tpacketOpts = append(tpacketOpts, afpacket.OptNumBlocks(numBlocks))
+	}
+	if opts.ImmediateMode {
+		tpacketOpts = append(tpacketOpts, afpacket.OptBlockTimeout(time.Millisecond))
+	}
+	numSockets := opts.Fanout
+	if numSockets < 1 {
+		numSockets = 1
+	}
+
+	var sources []Source
+	closeAll := func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}
+	var fanoutGroup uint16
+	for i := 0; i < numSockets; i++ {
+		tpacket, err := afpacket.NewTPacket(tpacketOpts...)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		src := &afpacketSource{
+			linkType: linkType,
+			parser:   newLayerParser(linkType),
+			tpacket:  tpacket,
+		}
+		sources = append(sources, src)
+		if filter != nil {
+			// Set before joining the fanout group, so that the socket
+			// only ever receives its share of filtered packets.
+			err = tpacket.SetBPF(filter)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			src.filteredSince = time.Now()
+		}
+		switch {
+		case numSockets == 1:
+		case i == 0:
+			fanoutGroup, err = joinFanoutGroup(tpacket)
+		default:
+			err = tpacket.SetFanout(afpacket.FanoutHash, fanoutGroup)
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+func (s *afpacketSource) NextPacket() (gopacket.Packet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if atomic.LoadInt32(&s.closing) != 0 {
+			return nil, ErrClosed
+		}
+		data, ci, err := s.tpacket.ZeroCopyReadPacketData()
+		if err == afpacket.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ci.Timestamp.Before(s.filteredSince) {
+			continue
+		}
+		return s.parser.decode(data, ci, strippedVLAN(ci)), nil
+	}
+}
+
+// strippedVLAN returns the VLAN identifier of the tag the NIC or kernel
+// removed from a packet, or -1 if it had none.
+func strippedVLAN(ci gopacket.CaptureInfo) int {
+	for _, data := range ci.AncillaryData {
+		if vlan, ok := data.(afpacket.AncillaryVLAN); ok {
+			return vlan.VLAN
+		}
+	}
+	return -1
+}
+
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *afpacketSource) Live() bool {
+	return true
+}
+
+// compileAFPacketFilter compiles the BPF filter expression for sockets on
+// devices of linkType.
+func compileAFPacketFilter(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, afpacketSnapLen, expr)
+	if err != nil {
+		return nil, err
+	}
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		filter[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	return filter, nil
+}
+
+// Close closes the socket once any read in progress has returned, within
+// afpacketPollTimeout.
+func (s *afpacketSource) Close() {
+	atomic.StoreInt32(&s.closing, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tpacket.Close()
+}
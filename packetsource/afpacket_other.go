@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package packetsource
+
+import (
+	"fmt"
+)
+
+func openAFPacket(device string, opts CaptureOptions) ([]Source, error) {
+	return nil, fmt.Errorf("the %s backend is only available on Linux", BackendAFPacket)
+}
@@ -0,0 +1,141 @@
+package packetsource
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// DefaultSnapLen is the number of bytes captured of each packet unless
+// CaptureOptions.SnapLen is set. Accounting only needs the headers, and
+// packet lengths are taken from the capture metadata.
+const DefaultSnapLen = 500
+
+// Capture backends selectable by CaptureOptions.Backend.
+const (
+	BackendPcap = "pcap"
+	// BackendAFPacket reads packets from memory-mapped AF_PACKET ring
+	// buffers and decodes them in place, which is much cheaper on busy
+	// links. It is only available on Linux, and does not support SnapLen or
+	// Promiscuous.
+	BackendAFPacket = "afpacket"
+)
+
+// CaptureOptions configure a live capture. Zero values select the defaults.
+type CaptureOptions struct {
+	// Backend is BackendPcap, the default, or BackendAFPacket.
+	Backend     string `json:"backend"`
+	SnapLen     int    `json:"snaplen"`
+	Promiscuous bool   `json:"promiscuous"`
+	// BufferSize is the size of the kernel capture buffer in bytes, per
+	// socket with Fanout.
+	BufferSize int `json:"buffer_size"`
+	// ImmediateMode delivers packets as soon as they arrive rather than
+	// once the buffer fills or times out.
+	ImmediateMode bool `json:"immediate_mode"`
+	// Fanout spreads packets by flow over this many AF_PACKET sockets, each
+	// read as a separate source by OpenFanout.
+	Fanout int `json:"fanout"`
+	// Filter is a BPF filter expression selecting the packets captured, and
+	// LinkFilter, if set, returns one for the link type of the device which
+	// packets must match as well. They are set before any packet is read,
+	// so that none escape them.
+	Filter     string                       `json:"-"`
+	LinkFilter func(layers.LinkType) string `json:"-"`
+}
+
+// FilterFor returns the filter expression of o for a device of linkType.
+func (o CaptureOptions) FilterFor(linkType layers.LinkType) string {
+	if o.LinkFilter == nil {
+		return o.Filter
+	}
+	return AndFilters(o.Filter, o.LinkFilter(linkType))
+}
+
+// Filterer is implemented by sources which can filter packets before they
+// are read, such as replayed captures. Live captures are filtered as opened,
+// by CaptureOptions.Filter.
+type Filterer interface {
+	// SetFilter sets a BPF filter expression, replacing any previous one.
+	SetFilter(expr string) error
+}
+
+// SetFilter sets a BPF filter expression on src, failing if src cannot
+// filter packets. An empty expression is ignored.
+func SetFilter(src Source, expr string) error {
+	if expr == "" {
+		return nil
+	}
+	f, ok := src.(Filterer)
+	if !ok {
+		return errors.New("packet source does not support filters")
+	}
+	return f.SetFilter(expr)
+}
+
+// AndFilters combines BPF filter expressions so that packets must match
+// each of them. Empty expressions are ignored.
+func AndFilters(exprs ...string) string {
+	var parts []string
+	for _, expr := range exprs {
+		if expr != "" {
+			parts = append(parts, expr)
+		}
+	}
+	if len(parts) <= 1 {
+		return strings.Join(parts, "")
+	}
+	return "(" + strings.Join(parts, ") and (") + ")"
+}
+
+func openLiveHandle(device string, opts CaptureOptions) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	snapLen := opts.SnapLen
+	if snapLen == 0 {
+		snapLen = DefaultSnapLen
+	}
+	err = inactive.SetSnapLen(snapLen)
+	if err != nil {
+		return nil, err
+	}
+	err = inactive.SetPromisc(opts.Promiscuous)
+	if err != nil {
+		return nil, err
+	}
+	err = inactive.SetTimeout(pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BufferSize > 0 {
+		err = inactive.SetBufferSize(opts.BufferSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ImmediateMode {
+		err = inactive.SetImmediateMode(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+	// libpcap also filters packets captured before the filter is set.
+	if expr := opts.FilterFor(handle.LinkType()); expr != "" {
+		err = handle.SetBPFFilter(expr)
+		if err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+	return handle, nil
+}
@@ -0,0 +1,335 @@
+package packetsource
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// layerParser decodes packets with a gopacket.DecodingLayerParser into
+// layers which are reused for every packet, so that decoding allocates
+// nothing. Packets it cannot fully decode that way, such as tunnelled ones
+// which contain a layer type twice, are decoded by gopacket.NewPacket
+// instead, so that they are accounted as from any other source.
+type layerParser struct {
+	linkType layers.LinkType
+	// parsers are by the type of the first layer.
+	parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	// byType holds the layers decoded by parsers.
+	byType map[gopacket.LayerType]gopacket.Layer
+
+	ethernet layers.Ethernet
+	dot1q    layers.Dot1Q
+	pppoe    pppoeLayer
+	ppp      pppLayer
+	ipv4     layers.IPv4
+	ipv6     layers.IPv6
+	tcp      layers.TCP
+	udp      layers.UDP
+	icmpv4   layers.ICMPv4
+	icmpv6   layers.ICMPv6
+	payload  gopacket.Payload
+
+	// vlan is the VLAN tag removed from the packet by the NIC, if any,
+	// restored as a layer so that it is accounted as in pcap captures.
+	vlan       layers.Dot1Q
+	vlanHeader [4]byte
+
+	types  []gopacket.LayerType
+	seen   map[gopacket.LayerType]bool
+	packet decodedPacket
+}
+
+func newLayerParser(linkType layers.LinkType) *layerParser {
+	p := &layerParser{
+		linkType: linkType,
+		parsers:  make(map[gopacket.LayerType]*gopacket.DecodingLayerParser),
+		byType:   make(map[gopacket.LayerType]gopacket.Layer),
+		seen:     make(map[gopacket.LayerType]bool),
+	}
+	decoding := []gopacket.DecodingLayer{
+		&p.ethernet, &p.dot1q, &p.pppoe, &p.ppp, &p.ipv4, &p.ipv6,
+		&p.tcp, &p.udp, &p.icmpv4, &p.icmpv6, &p.payload,
+	}
+	for _, layer := range decoding {
+		p.byType[layer.(gopacket.Layer).LayerType()] = layer.(gopacket.Layer)
+	}
+	var first []gopacket.LayerType
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		first = []gopacket.LayerType{layers.LayerTypeEthernet}
+	case layers.LinkTypeRaw:
+		first = []gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeIPv6}
+	}
+	for _, t := range first {
+		p.parsers[t] = gopacket.NewDecodingLayerParser(t, decoding...)
+	}
+	return p
+}
+
+// firstLayer returns the type of the first layer of data.
+func (p *layerParser) firstLayer(data []byte) gopacket.LayerType {
+	if p.linkType != layers.LinkTypeRaw {
+		return layers.LayerTypeEthernet
+	}
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeIPv4
+}
+
+// isTransport reports whether decoding may stop after a layer of type t
+// without losing anything accounted.
+func isTransport(t gopacket.LayerType) bool {
+	switch t {
+	case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4,
+		layers.LayerTypeICMPv6, gopacket.LayerTypePayload:
+		return true
+	}
+	return false
+}
+
+// decode decodes data captured as described by ci, whose VLAN tag with
+// identifier vlan was removed before capture unless vlan is -1. The packet
+// returned and its layers are only valid until the next call.
+func (p *layerParser) decode(data []byte, ci gopacket.CaptureInfo, vlan int) gopacket.Packet {
+	parser := p.parsers[p.firstLayer(data)]
+	if parser == nil {
+		return p.decodeFully(data, ci)
+	}
+	err := parser.DecodeLayers(data, &p.types)
+	_, unsupported := err.(gopacket.UnsupportedLayerType)
+	if (err == nil || unsupported) &&
+		(len(p.types) == 0 || !isTransport(p.types[len(p.types)-1])) {
+		return p.decodeFully(data, ci)
+	}
+	// Other errors leave the layers decoded before them, as gopacket.Packet
+	// ends with an error layer.
+
+	for t := range p.seen {
+		delete(p.seen, t)
+	}
+	p.packet = decodedPacket{data: data, layers: p.packet.layers[:0]}
+	for _, t := range p.types {
+		if p.seen[t] {
+			// Layers decoded twice, as in tunnels, only hold the inner one.
+			return p.decodeFully(data, ci)
+		}
+		p.seen[t] = true
+		p.packet.layers = append(p.packet.layers, p.byType[t])
+	}
+	if vlan >= 0 && len(p.packet.layers) > 0 && p.packet.layers[0] == &p.ethernet {
+		p.restoreVLAN(uint16(vlan))
+		// The length on the wire included the tag.
+		ci.Length += len(p.vlanHeader)
+	}
+	p.packet.metadata.CaptureInfo = ci
+	return &p.packet
+}
+
+// restoreVLAN inserts a Dot1Q layer tagged vlan after the Ethernet layer of
+// the packet. Its contents are those of the tag, as it was on the wire.
+func (p *layerParser) restoreVLAN(vlan uint16) {
+	binary.BigEndian.PutUint16(p.vlanHeader[0:2], vlan)
+	binary.BigEndian.PutUint16(p.vlanHeader[2:4], uint16(p.ethernet.EthernetType))
+	p.vlan = layers.Dot1Q{
+		BaseLayer:      layers.BaseLayer{Contents: p.vlanHeader[:]},
+		VLANIdentifier: vlan,
+		Type:           p.ethernet.EthernetType,
+	}
+	p.packet.layers = append(p.packet.layers, nil)
+	copy(p.packet.layers[2:], p.packet.layers[1:])
+	p.packet.layers[1] = &p.vlan
+}
+
+// decodeFully decodes data with gopacket.NewPacket. A VLAN tag removed from
+// the packet before capture is not accounted then.
+func (p *layerParser) decodeFully(data []byte, ci gopacket.CaptureInfo) gopacket.Packet {
+	packet := gopacket.NewPacket(data, p.linkType, gopacket.NoCopy)
+	packet.Metadata().CaptureInfo = ci
+	return packet
+}
+
+// pppoeLayer decodes PPPoE as gopacket.DecodingLayer, which layers.PPPoE
+// does not implement.
+type pppoeLayer struct {
+	layers.PPPoE
+}
+
+func (l *pppoeLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 6 {
+		df.SetTruncated()
+		return errors.New("PPPoE header too short")
+	}
+	l.Version = data[0] >> 4
+	l.Type = data[0] & 0x0F
+	l.Code = layers.PPPoECode(data[1])
+	l.SessionId = binary.BigEndian.Uint16(data[2:4])
+	l.Length = binary.BigEndian.Uint16(data[4:6])
+	if 6+int(l.Length) > len(data) {
+		df.SetTruncated()
+		return errors.New("PPPoE length exceeds packet")
+	}
+	l.BaseLayer = layers.BaseLayer{Contents: data[:6], Payload: data[6 : 6+int(l.Length)]}
+	return nil
+}
+
+func (l *pppoeLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypePPPoE
+}
+
+func (l *pppoeLayer) NextLayerType() gopacket.LayerType {
+	if l.Code != layers.PPPoECodeSession {
+		return gopacket.LayerTypeZero
+	}
+	return layers.LayerTypePPP
+}
+
+// pppLayer decodes PPP as gopacket.DecodingLayer, which layers.PPP does not
+// implement.
+type pppLayer struct {
+	layers.PPP
+}
+
+func (l *pppLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	offset := 0
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0x03 {
+		offset = 2
+		l.HasPPTPHeader = true
+	} else {
+		l.HasPPTPHeader = false
+	}
+	if len(data) < offset+1 {
+		df.SetTruncated()
+		return errors.New("PPP header too short")
+	}
+	size := 1
+	if data[offset]&0x1 == 0 {
+		if len(data) < offset+2 {
+			df.SetTruncated()
+			return errors.New("PPP header too short")
+		}
+		if data[offset+1]&0x1 == 0 {
+			return errors.New("PPP has invalid type")
+		}
+		l.PPPType = layers.PPPType(binary.BigEndian.Uint16(data[offset : offset+2]))
+		size = 2
+	} else {
+		l.PPPType = layers.PPPType(data[offset])
+	}
+	// As decoded by gopacket, the PPTP header is in neither.
+	l.BaseLayer = layers.BaseLayer{Contents: data[offset : offset+size], Payload: data[offset+size:]}
+	return nil
+}
+
+func (l *pppLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypePPP
+}
+
+func (l *pppLayer) NextLayerType() gopacket.LayerType {
+	switch l.PPPType {
+	case layers.PPPTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.PPPTypeIPv6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypeZero
+}
+
+// decodedPacket is a gopacket.Packet of layers decoded by a layerParser.
+type decodedPacket struct {
+	data     []byte
+	metadata gopacket.PacketMetadata
+	layers   []gopacket.Layer
+}
+
+func (p *decodedPacket) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "PACKET: %d bytes\n", len(p.data))
+	for i, layer := range p.layers {
+		fmt.Fprintf(&s, "- Layer %d (%02d bytes) = %s\n", i+1, len(layer.LayerContents()), gopacket.LayerString(layer))
+	}
+	return s.String()
+}
+
+func (p *decodedPacket) Dump() string {
+	var s strings.Builder
+	for i, layer := range p.layers {
+		fmt.Fprintf(&s, "-- Layer %d --\n%s", i+1, gopacket.LayerDump(layer))
+	}
+	return s.String()
+}
+
+func (p *decodedPacket) Layers() []gopacket.Layer {
+	return p.layers
+}
+
+func (p *decodedPacket) Layer(t gopacket.LayerType) gopacket.Layer {
+	for _, layer := range p.layers {
+		if layer.LayerType() == t {
+			return layer
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) LayerClass(c gopacket.LayerClass) gopacket.Layer {
+	for _, layer := range p.layers {
+		if c.Contains(layer.LayerType()) {
+			return layer
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) LinkLayer() gopacket.LinkLayer {
+	for _, layer := range p.layers {
+		if l, ok := layer.(gopacket.LinkLayer); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) NetworkLayer() gopacket.NetworkLayer {
+	for _, layer := range p.layers {
+		if l, ok := layer.(gopacket.NetworkLayer); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) TransportLayer() gopacket.TransportLayer {
+	for _, layer := range p.layers {
+		if l, ok := layer.(gopacket.TransportLayer); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) ApplicationLayer() gopacket.ApplicationLayer {
+	for _, layer := range p.layers {
+		if l, ok := layer.(gopacket.ApplicationLayer); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+func (p *decodedPacket) ErrorLayer() gopacket.ErrorLayer {
+	return nil
+}
+
+func (p *decodedPacket) Data() []byte {
+	return p.data
+}
+
+func (p *decodedPacket) Metadata() *gopacket.PacketMetadata {
+	return &p.metadata
+}
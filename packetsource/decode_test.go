@@ -0,0 +1,225 @@
+package packetsource
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/interarticle/bandwidth_recorder/layerinfo"
+)
+
+var (
+	testMAC1 = mustParseMAC("02:00:00:00:00:01")
+	testMAC2 = mustParseMAC("02:00:00:00:00:02")
+)
+
+func mustParseMAC(s string) net.HardwareAddr {
+	addr, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func testIPv4(protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{1, 1, 1, 1},
+	}
+}
+
+func testIPv6(next layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: next,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+}
+
+func testEthernet(t layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: testMAC1, DstMAC: testMAC2, EthernetType: t}
+}
+
+func testUDP(network gopacket.NetworkLayer) *layers.UDP {
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(network)
+	return udp
+}
+
+func testTCP(network gopacket.NetworkLayer) *layers.TCP {
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 443, Window: 1024, ACK: true}
+	tcp.SetNetworkLayerForChecksum(network)
+	return tcp
+}
+
+// testPayload is long enough that no frame is padded to the Ethernet minimum.
+var testPayload = gopacket.Payload(make([]byte, 100))
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// withoutLayers clears the layers of b, which are distinct values for each
+// decoder even when they describe the same packet.
+func withoutLayers(b layerinfo.Breakdown) layerinfo.Breakdown {
+	b.Link, b.Network, b.Transport = nil, nil, nil
+	return b
+}
+
+func TestLayerParserMatchesNewPacket(t *testing.T) {
+	tcpIPv4 := testIPv4(layers.IPProtocolTCP)
+	udpIPv4 := testIPv4(layers.IPProtocolUDP)
+	pppoeIPv4 := testIPv4(layers.IPProtocolUDP)
+	pppoeIPv6 := testIPv6(layers.IPProtocolTCP)
+	rawIPv4 := testIPv4(layers.IPProtocolUDP)
+	rawIPv6 := testIPv6(layers.IPProtocolUDP)
+	tunnelled := testIPv4(layers.IPProtocolUDP)
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		data     []byte
+		// fast is whether the packet is decoded without gopacket.NewPacket.
+		fast bool
+	}{
+		{
+			name:     "ethernet",
+			linkType: layers.LinkTypeEthernet,
+			data: serialize(t, testEthernet(layers.EthernetTypeIPv4),
+				tcpIPv4, testTCP(tcpIPv4), testPayload),
+			fast: true,
+		},
+		{
+			name:     "vlan",
+			linkType: layers.LinkTypeEthernet,
+			data: serialize(t, testEthernet(layers.EthernetTypeDot1Q),
+				&layers.Dot1Q{VLANIdentifier: 7, Type: layers.EthernetTypeIPv4},
+				udpIPv4, testUDP(udpIPv4), testPayload),
+			fast: true,
+		},
+		{
+			name:     "vlan pppoe ipv4",
+			linkType: layers.LinkTypeEthernet,
+			data: serialize(t, testEthernet(layers.EthernetTypeDot1Q),
+				&layers.Dot1Q{VLANIdentifier: 7, Type: layers.EthernetTypePPPoESession},
+				&layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodeSession, SessionId: 1},
+				&layers.PPP{PPPType: layers.PPPTypeIPv4},
+				pppoeIPv4, testUDP(pppoeIPv4), testPayload),
+			fast: true,
+		},
+		{
+			name:     "pppoe ipv6",
+			linkType: layers.LinkTypeEthernet,
+			data: serialize(t, testEthernet(layers.EthernetTypePPPoESession),
+				&layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodeSession, SessionId: 1},
+				&layers.PPP{PPPType: layers.PPPTypeIPv6},
+				pppoeIPv6, testTCP(pppoeIPv6), testPayload),
+			fast: true,
+		},
+		{
+			name:     "raw ipv4",
+			linkType: layers.LinkTypeRaw,
+			data:     serialize(t, rawIPv4, testUDP(rawIPv4), testPayload),
+			fast:     true,
+		},
+		{
+			name:     "raw ipv6",
+			linkType: layers.LinkTypeRaw,
+			data:     serialize(t, rawIPv6, testUDP(rawIPv6), testPayload),
+			fast:     true,
+		},
+		{
+			name:     "gre tunnel",
+			linkType: layers.LinkTypeEthernet,
+			data: serialize(t, testEthernet(layers.EthernetTypeIPv4),
+				testIPv4(layers.IPProtocolGRE),
+				&layers.GRE{Protocol: layers.EthernetTypeIPv4},
+				tunnelled, testUDP(tunnelled), testPayload),
+		},
+		{
+			name:     "arp",
+			linkType: layers.LinkTypeEthernet,
+			data: serialize(t, testEthernet(layers.EthernetTypeARP), &layers.ARP{
+				AddrType:          layers.LinkTypeEthernet,
+				Protocol:          layers.EthernetTypeIPv4,
+				HwAddressSize:     6,
+				ProtAddressSize:   4,
+				SourceHwAddress:   testMAC1,
+				SourceProtAddress: []byte{10, 0, 0, 1},
+				DstHwAddress:      testMAC2,
+				DstProtAddress:    []byte{10, 0, 0, 2},
+			}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Packets are truncated in captures, but accounted by their
+			// length on the wire.
+			ci := gopacket.CaptureInfo{CaptureLength: len(test.data), Length: len(test.data) + 20}
+			got := newLayerParser(test.linkType).decode(test.data, ci, -1)
+			want := gopacket.NewPacket(test.data, test.linkType, gopacket.Default)
+			if _, fast := got.(*decodedPacket); fast != test.fast {
+				t.Errorf("decoded without gopacket.NewPacket = %v, want %v", fast, test.fast)
+			}
+			var gotBreakdown, wantBreakdown layerinfo.Breakdown
+			gotBreakdown.Analyze(got.Metadata().Length, got.Layers())
+			wantBreakdown.Analyze(ci.Length, want.Layers())
+			if !reflect.DeepEqual(withoutLayers(gotBreakdown), withoutLayers(wantBreakdown)) {
+				t.Errorf("breakdown = %+v, want %+v", withoutLayers(gotBreakdown), withoutLayers(wantBreakdown))
+			}
+		})
+	}
+}
+
+func TestLayerParserRestoresStrippedVLAN(t *testing.T) {
+	ipv4 := testIPv4(layers.IPProtocolUDP)
+	udp := testUDP(ipv4)
+	tagged := serialize(t, testEthernet(layers.EthernetTypeDot1Q),
+		&layers.Dot1Q{VLANIdentifier: 7, Type: layers.EthernetTypeIPv4},
+		ipv4, udp, testPayload)
+	stripped := serialize(t, testEthernet(layers.EthernetTypeIPv4), ipv4, udp, testPayload)
+
+	ci := gopacket.CaptureInfo{CaptureLength: len(stripped), Length: len(stripped)}
+	got := newLayerParser(layers.LinkTypeEthernet).decode(stripped, ci, 7)
+	want := gopacket.NewPacket(tagged, layers.LinkTypeEthernet, gopacket.Default)
+	if got.Metadata().Length != len(tagged) {
+		t.Errorf("length = %d, want %d", got.Metadata().Length, len(tagged))
+	}
+	var gotBreakdown, wantBreakdown layerinfo.Breakdown
+	gotBreakdown.Analyze(got.Metadata().Length, got.Layers())
+	wantBreakdown.Analyze(len(tagged), want.Layers())
+	if !reflect.DeepEqual(withoutLayers(gotBreakdown), withoutLayers(wantBreakdown)) {
+		t.Errorf("breakdown = %+v, want %+v", withoutLayers(gotBreakdown), withoutLayers(wantBreakdown))
+	}
+	dot1q, ok := got.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok || dot1q.VLANIdentifier != 7 {
+		t.Errorf("Dot1Q layer = %v, want VLAN 7", got.Layer(layers.LayerTypeDot1Q))
+	}
+}
+
+func TestLayerParserDoesNotAllocate(t *testing.T) {
+	ipv4 := testIPv4(layers.IPProtocolUDP)
+	data := serialize(t, testEthernet(layers.EthernetTypeIPv4), ipv4, testUDP(ipv4), testPayload)
+	p := newLayerParser(layers.LinkTypeEthernet)
+	ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+	p.decode(data, ci, 7)
+	allocs := testing.AllocsPerRun(100, func() {
+		p.decode(data, ci, 7)
+	})
+	if allocs != 0 {
+		t.Errorf("decode allocated %v times per packet, want 0", allocs)
+	}
+}
@@ -0,0 +1,123 @@
+package packetsource
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Direction is the direction of a packet as seen by the capturing host.
+type Direction int
+
+const (
+	DirectionUnknown Direction = iota
+	// DirectionIn packets were received by the host.
+	DirectionIn
+	// DirectionOut packets were sent by the host.
+	DirectionOut
+)
+
+// directedPacket is a packet whose direction is known from how it was
+// captured.
+type directedPacket struct {
+	gopacket.Packet
+	direction Direction
+}
+
+// PacketDirection returns the direction of a packet, if known from the
+// source it was read from, as with OpenLiveDirectional, or from its Linux
+// cooked capture header.
+func PacketDirection(packet gopacket.Packet) Direction {
+	if p, ok := packet.(*directedPacket); ok {
+		return p.direction
+	}
+	if sll, ok := packet.LinkLayer().(*layers.LinuxSLL); ok {
+		if sll.PacketType == layers.LinuxSLLPacketTypeOutgoing {
+			return DirectionOut
+		}
+		return DirectionIn
+	}
+	return DirectionUnknown
+}
+
+type packetOrError struct {
+	packet gopacket.Packet
+	err    error
+}
+
+// directionalSource merges packets captured by two handles, one only
+// capturing received packets and the other sent ones.
+type directionalSource struct {
+	in, out *pcapSource
+	packets chan packetOrError
+}
+
+// OpenLiveDirectional captures packets from the named network device like
+// OpenLive, but captures received and sent packets separately so that their
+// direction is known to PacketDirection. Packets of both directions are not
+// strictly ordered by capture time. Filters must be set by opts, as packets
+// are read from when it returns.
+func OpenLiveDirectional(device string, opts CaptureOptions) (Source, error) {
+	if (opts.Backend != "" && opts.Backend != BackendPcap) || opts.Fanout > 1 {
+		return nil, errors.New("capture direction is only known with the pcap backend")
+	}
+	s := &directionalSource{packets: make(chan packetOrError, 1024)}
+	for _, d := range []struct {
+		source    **pcapSource
+		direction pcap.Direction
+	}{
+		{&s.in, pcap.DirectionIn},
+		{&s.out, pcap.DirectionOut},
+	} {
+		handle, err := openLiveHandle(device, opts)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		err = handle.SetDirection(d.direction)
+		if err != nil {
+			handle.Close()
+			s.Close()
+			return nil, err
+		}
+		*d.source = newPcapSource(handle, true)
+	}
+	go s.read(s.in, DirectionIn)
+	go s.read(s.out, DirectionOut)
+	return s, nil
+}
+
+func (s *directionalSource) read(src *pcapSource, direction Direction) {
+	for {
+		packet, err := src.NextPacket()
+		if err != nil {
+			s.packets <- packetOrError{err: err}
+			return
+		}
+		s.packets <- packetOrError{packet: &directedPacket{Packet: packet, direction: direction}}
+	}
+}
+
+func (s *directionalSource) NextPacket() (gopacket.Packet, error) {
+	p := <-s.packets
+	return p.packet, p.err
+}
+
+func (s *directionalSource) LinkType() layers.LinkType {
+	return s.in.LinkType()
+}
+
+func (s *directionalSource) Live() bool {
+	return true
+}
+
+func (s *directionalSource) Close() {
+	if s.in != nil {
+		s.in.Close()
+	}
+	if s.out != nil {
+		s.out.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package packetsource
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+type pcapSource struct {
+	handle  *pcap.Handle
+	packets *gopacket.PacketSource
+	live    bool
+}
+
+func newPcapSource(handle *pcap.Handle, live bool) *pcapSource {
+	return &pcapSource{
+		handle:  handle,
+		packets: gopacket.NewPacketSource(handle, handle.LinkType()),
+		live:    live,
+	}
+}
+
+// OpenLive captures packets from the named network device with the backend
+// selected by opts, which must not use fanout.
+func OpenLive(device string, opts CaptureOptions) (Source, error) {
+	if opts.Fanout > 1 {
+		return nil, errors.New("fanout captures must be opened with OpenFanout")
+	}
+	sources, err := OpenFanout(device, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sources[0], nil
+}
+
+// OpenFanout captures packets from the named network device like OpenLive,
+// but with opts.Fanout sources which each receive a share of the packets by
+// flow, so that they can be read concurrently.
+func OpenFanout(device string, opts CaptureOptions) ([]Source, error) {
+	switch opts.Backend {
+	case "", BackendPcap:
+	case BackendAFPacket:
+		return openAFPacket(device, opts)
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q", opts.Backend)
+	}
+	if opts.Fanout > 1 {
+		return nil, fmt.Errorf("fanout needs the %s backend", BackendAFPacket)
+	}
+	handle, err := openLiveHandle(device, opts)
+	if err != nil {
+		return nil, err
+	}
+	return []Source{newPcapSource(handle, true)}, nil
+}
+
+// OpenFile replays packets from a pcap or pcapng file.
+func OpenFile(path string) (Source, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, err
+	}
+	return newPcapSource(handle, false), nil
+}
+
+func (s *pcapSource) NextPacket() (gopacket.Packet, error) {
+	return s.packets.NextPacket()
+}
+
+func (s *pcapSource) LinkType() layers.LinkType {
+	return s.handle.LinkType()
+}
+
+func (s *pcapSource) Live() bool {
+	return s.live
+}
+
+func (s *pcapSource) SetFilter(expr string) error {
+	return s.handle.SetBPFFilter(expr)
+}
+
+func (s *pcapSource) Close() {
+	s.handle.Close()
+}
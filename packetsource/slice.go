@@ -0,0 +1,43 @@
+package packetsource
+
+import (
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type sliceSource struct {
+	packets  []gopacket.Packet
+	linkType layers.LinkType
+}
+
+// FromSlice returns a Source which yields the given packets in order and then
+// io.EOF.
+func FromSlice(linkType layers.LinkType, packets []gopacket.Packet) Source {
+	return &sliceSource{
+		packets:  packets,
+		linkType: linkType,
+	}
+}
+
+func (s *sliceSource) NextPacket() (gopacket.Packet, error) {
+	if len(s.packets) == 0 {
+		return nil, io.EOF
+	}
+	packet := s.packets[0]
+	s.packets = s.packets[1:]
+	return packet, nil
+}
+
+func (s *sliceSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *sliceSource) Live() bool {
+	return false
+}
+
+func (s *sliceSource) Close() {
+	s.packets = nil
+}
@@ -0,0 +1,37 @@
+// Package packetsource abstracts where the monitoring workers read packets
+// from, so that the same accounting logic can run against a live interface,
+// a capture file or packets held in memory.
+package packetsource
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Source produces decoded packets. NextPacket returns io.EOF once a finite
+// source has been exhausted. A packet and its layers may share storage with
+// the source, and must not be used after the next call to NextPacket.
+type Source interface {
+	NextPacket() (gopacket.Packet, error)
+	LinkType() layers.LinkType
+	// Live reports whether packets are being captured as they arrive, as
+	// opposed to being replayed; replayed packets should be accounted at
+	// their capture time rather than at the current time.
+	Live() bool
+	Close()
+}
+
+// ErrClosed is returned by sources which are read after being closed.
+var ErrClosed = errors.New("packet source closed")
+
+// PacketTime returns the time at which a packet from src should be
+// accounted.
+func PacketTime(src Source, packet gopacket.Packet) time.Time {
+	if src.Live() {
+		return time.Now()
+	}
+	return packet.Metadata().Timestamp
+}
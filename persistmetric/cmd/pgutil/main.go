@@ -44,6 +44,25 @@ func main() {
 		log.Print(string(json))
 	}
 
+	archived, err := storage.ListArchivedMetrics()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, metric := range archived {
+		log.Printf("Archived metric %s:", metric)
+		value, err := storage.ReadArchive(metric)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		json, err := json.Marshal(&value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print(string(json))
+	}
+
 	if *setMetric != "" {
 		if *newMetricValues == "" {
 			log.Fatal("Both --set_metric and --new_metric_values must be set")
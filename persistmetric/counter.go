@@ -1,29 +1,16 @@
 package persistmetric
 
 import (
-	"bytes"
 	"errors"
-	"fmt"
-	"log"
-	"sort"
-	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const (
-	timeWindowStartLabelName = "since"
-)
-
 type Counter struct {
-	s          *Storage
-	counterVec *prometheus.GaugeVec
-
-	mu           sync.Mutex
-	metricName   string
-	sinceToValue map[string]map[string]*MetricValue
+	series
 
-	options *options
+	counterVec *prometheus.GaugeVec
 }
 
 type CounterWithLabels struct {
@@ -33,75 +20,40 @@ type CounterWithLabels struct {
 	userLabelKey string
 }
 
+// Add adds delta to the period labelled since. It must only be used on
+// counters created without windows.
 func (cl *CounterWithLabels) Add(since string, delta float64) {
-	labelValues := append(cl.labelValues, since)
-	cl.c.counterVec.WithLabelValues(labelValues...).Add(delta)
-
-	cl.c.mu.Lock()
-	defer cl.c.mu.Unlock()
-	var sinceMap map[string]*MetricValue
-	var ok bool
-	if sinceMap, ok = cl.c.sinceToValue[since]; !ok {
-		sinceMap = make(map[string]*MetricValue)
-		cl.c.sinceToValue[since] = sinceMap
-	}
-	var value *MetricValue
-	if value, ok = sinceMap[cl.userLabelKey]; !ok {
-		value = &MetricValue{
-			Since:  since,
-			Value:  0,
-			Labels: cl.labelValues,
-		}
-		sinceMap[cl.userLabelKey] = value
-	}
-	value.Value += delta
+	cl.add(cl.c.key("Add", since), delta)
 }
 
-func userLabelKey(labels []string) string {
-	var buffer bytes.Buffer
-	for _, label := range labels {
-		buffer.WriteString(fmt.Sprintf("%d ", len(label)))
-		buffer.WriteString(label)
+// AddAt adds delta to the period containing t in every window of the counter.
+func (cl *CounterWithLabels) AddAt(t time.Time, delta float64) {
+	for _, key := range cl.c.keys("AddAt", t) {
+		cl.add(key, delta)
 	}
-	return buffer.String()
 }
 
-func newCounter(s *Storage, counterOpts prometheus.Opts, opts *options) *Counter {
-	allLabels := append(opts.variableLabels, timeWindowStartLabelName)
-	return &Counter{
-		s: s,
-		counterVec: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts(counterOpts), allLabels),
-		metricName: fmt.Sprintf("%s::%s::%s", counterOpts.Namespace,
-			counterOpts.Subsystem, counterOpts.Name),
-		options: opts,
-	}
-}
+func (cl *CounterWithLabels) add(key sinceKey, delta float64) {
+	cl.c.counterVec.WithLabelValues(cl.c.prometheusLabelValues(cl.labelValues, key)...).Add(delta)
 
-func (c *Counter) loadSavedValues() error {
-	if c.sinceToValue != nil {
-		return errors.New("already initialized")
-	}
+	cl.c.update(cl.labelValues, cl.userLabelKey, key, func(value *MetricValue, created bool) {
+		value.Value += delta
+	})
+}
 
-	values, err := c.s.ReadMetric(c.metricName)
-	if err != nil {
-		return err
-	}
+func sumValues(into *MetricValue, value MetricValue) {
+	into.Value += value.Value
+}
 
-	c.sinceToValue = make(map[string]map[string]*MetricValue)
-	for _, value := range values {
-		labelValues := append(value.Labels, value.Since)
-		c.counterVec.WithLabelValues(labelValues...).Set(value.Value)
-
-		var sinceMap map[string]*MetricValue
-		var ok bool
-		if sinceMap, ok = c.sinceToValue[value.Since]; !ok {
-			sinceMap = make(map[string]*MetricValue)
-			c.sinceToValue[value.Since] = sinceMap
-		}
-		sinceMap[userLabelKey(value.Labels)] = &value
+func newCounter(s *Storage, counterOpts prometheus.Opts, opts *options) *Counter {
+	c := &Counter{series: newSeries(s, counterOpts, opts)}
+	c.counterVec = prometheus.NewGaugeVec(prometheus.GaugeOpts(counterOpts), c.labelNames())
+	c.loaded = func(labelValues []string, key sinceKey, value *MetricValue) bool {
+		c.counterVec.WithLabelValues(c.prometheusLabelValues(labelValues, key)...).Set(value.Value)
+		return true
 	}
-	return nil
+	c.merge = sumValues
+	return c
 }
 
 func (c *Counter) Describe(ch chan<- *prometheus.Desc) {
@@ -110,13 +62,7 @@ func (c *Counter) Describe(ch chan<- *prometheus.Desc) {
 
 func (c *Counter) Collect(ch chan<- prometheus.Metric) {
 	c.counterVec.Collect(ch)
-
-	go func() {
-		err := c.saveMetrics()
-		if err != nil {
-			log.Printf("Warning: failed to save metrics: %v", err)
-		}
-	}()
+	c.collected()
 }
 
 func (c *Counter) WithLabelValues(labelValues ...string) *CounterWithLabels {
@@ -133,41 +79,18 @@ func (c *Counter) WithLabelValues(labelValues ...string) *CounterWithLabels {
 	}
 }
 
+// Value returns the current value of the counter for the given labels in the
+// period labelled since of the named window. windowName is empty for
+// counters created without windows.
+func (c *Counter) Value(windowName, since string, labelValues ...string) float64 {
+	value, _ := c.value(windowName, since, labelValues)
+	return value.Value
+}
+
 func (c *Counter) Add(since string, delta float64) {
 	c.WithLabelValues().Add(since, delta)
 }
 
-func (c *Counter) saveMetrics() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.sinceToValue == nil {
-		return errors.New("not initialized")
-	}
-
-	// Compact map.
-	var keys, dropKeys []string
-	for k := range c.sinceToValue {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	if len(keys) > c.options.numOldRecordsToKeep {
-		dropKeys = keys[0 : len(keys)-c.options.numOldRecordsToKeep]
-		keys = keys[len(keys)-c.options.numOldRecordsToKeep : len(keys)]
-	}
-
-	for _, key := range dropKeys {
-		delete(c.sinceToValue, key)
-	}
-
-	// Save metrics.
-	var values MetricValues
-	for _, key := range keys {
-		for _, value := range c.sinceToValue[key] {
-			values = append(values, *value)
-		}
-	}
-
-	return c.s.WriteMetric(c.metricName, values)
+func (c *Counter) AddAt(t time.Time, delta float64) {
+	c.WithLabelValues().AddAt(t, delta)
 }
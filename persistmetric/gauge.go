@@ -0,0 +1,116 @@
+package persistmetric
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gauge is a persisted metric holding the last value set in each period, or
+// with SetMaxAt the largest, e.g. the peak throughput of each month. When
+// archived periods roll up under a retention policy, they keep the largest
+// value.
+type Gauge struct {
+	series
+
+	gaugeVec *prometheus.GaugeVec
+}
+
+type GaugeWithLabels struct {
+	g *Gauge
+
+	labelValues  []string
+	userLabelKey string
+}
+
+// Set sets the value of the period labelled since. It must only be used on
+// gauges created without windows.
+func (gl *GaugeWithLabels) Set(since string, v float64) {
+	gl.set(gl.g.key("Set", since), v, false)
+}
+
+// SetAt sets the value of the period containing t in every window of the
+// gauge.
+func (gl *GaugeWithLabels) SetAt(t time.Time, v float64) {
+	for _, key := range gl.g.keys("SetAt", t) {
+		gl.set(key, v, false)
+	}
+}
+
+// SetMaxAt sets the value of the period containing t in every window of the
+// gauge to v, if v is larger than it.
+func (gl *GaugeWithLabels) SetMaxAt(t time.Time, v float64) {
+	for _, key := range gl.g.keys("SetMaxAt", t) {
+		gl.set(key, v, true)
+	}
+}
+
+func (gl *GaugeWithLabels) set(key sinceKey, v float64, max bool) {
+	gl.g.update(gl.labelValues, gl.userLabelKey, key, func(value *MetricValue, created bool) {
+		if max && !created && v <= value.Value {
+			return
+		}
+		value.Value = v
+		gl.g.gaugeVec.WithLabelValues(gl.g.prometheusLabelValues(gl.labelValues, key)...).Set(v)
+	})
+}
+
+func maxValues(into *MetricValue, value MetricValue) {
+	if value.Value > into.Value {
+		into.Value = value.Value
+	}
+}
+
+func newGauge(s *Storage, gaugeOpts prometheus.Opts, opts *options) *Gauge {
+	g := &Gauge{series: newSeries(s, gaugeOpts, opts)}
+	g.gaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts(gaugeOpts), g.labelNames())
+	g.loaded = func(labelValues []string, key sinceKey, value *MetricValue) bool {
+		g.gaugeVec.WithLabelValues(g.prometheusLabelValues(labelValues, key)...).Set(value.Value)
+		return true
+	}
+	g.merge = maxValues
+	return g
+}
+
+func (g *Gauge) Describe(ch chan<- *prometheus.Desc) {
+	g.gaugeVec.Describe(ch)
+}
+
+func (g *Gauge) Collect(ch chan<- prometheus.Metric) {
+	g.gaugeVec.Collect(ch)
+	g.collected()
+}
+
+func (g *Gauge) WithLabelValues(labelValues ...string) *GaugeWithLabels {
+	if g.sinceToValue == nil {
+		panic(errors.New("not initialized"))
+	}
+
+	newLabelValues := make([]string, len(labelValues))
+	copy(newLabelValues, labelValues)
+	return &GaugeWithLabels{
+		g:            g,
+		labelValues:  newLabelValues,
+		userLabelKey: userLabelKey(labelValues),
+	}
+}
+
+// Value returns the current value of the gauge for the given labels in the
+// period labelled since of the named window.
+func (g *Gauge) Value(windowName, since string, labelValues ...string) float64 {
+	value, _ := g.value(windowName, since, labelValues)
+	return value.Value
+}
+
+func (g *Gauge) Set(since string, v float64) {
+	g.WithLabelValues().Set(since, v)
+}
+
+func (g *Gauge) SetAt(t time.Time, v float64) {
+	g.WithLabelValues().SetAt(t, v)
+}
+
+func (g *Gauge) SetMaxAt(t time.Time, v float64) {
+	g.WithLabelValues().SetMaxAt(t, v)
+}
@@ -0,0 +1,177 @@
+package persistmetric
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Histogram is a persisted metric counting observations per period in
+// buckets, e.g. the distribution of packet sizes of each month. Its values
+// hold the sum of observations in Value, their number in Count and the
+// number of observations in each bucket, not cumulatively, in Buckets.
+type Histogram struct {
+	series
+
+	desc    *prometheus.Desc
+	buckets []float64
+}
+
+type HistogramWithLabels struct {
+	h *Histogram
+
+	labelValues  []string
+	userLabelKey string
+}
+
+// Observe adds an observation to the period labelled since. It must only be
+// used on histograms created without windows.
+func (hl *HistogramWithLabels) Observe(since string, v float64) {
+	hl.observe(hl.h.key("Observe", since), v)
+}
+
+// ObserveAt adds an observation to the period containing t in every window
+// of the histogram.
+func (hl *HistogramWithLabels) ObserveAt(t time.Time, v float64) {
+	for _, key := range hl.h.keys("ObserveAt", t) {
+		hl.observe(key, v)
+	}
+}
+
+func (hl *HistogramWithLabels) observe(key sinceKey, v float64) {
+	i := sort.SearchFloat64s(hl.h.buckets, v)
+	hl.h.update(hl.labelValues, hl.userLabelKey, key, func(value *MetricValue, created bool) {
+		if created {
+			value.Buckets = make([]uint64, len(hl.h.buckets))
+		}
+		if i < len(value.Buckets) {
+			value.Buckets[i]++
+		}
+		value.Count++
+		value.Value += v
+	})
+}
+
+func sumHistograms(into *MetricValue, value MetricValue) {
+	into.Value += value.Value
+	into.Count += value.Count
+	for i := range into.Buckets {
+		if i < len(value.Buckets) {
+			into.Buckets[i] += value.Buckets[i]
+		}
+	}
+}
+
+func newHistogram(s *Storage, histogramOpts prometheus.HistogramOpts, opts *options) *Histogram {
+	h := &Histogram{
+		series: newSeries(s, prometheus.Opts{
+			Namespace: histogramOpts.Namespace,
+			Subsystem: histogramOpts.Subsystem,
+			Name:      histogramOpts.Name,
+		}, opts),
+		buckets: histogramOpts.Buckets,
+	}
+	if h.buckets == nil {
+		h.buckets = prometheus.DefBuckets
+	}
+	h.desc = prometheus.NewDesc(h.name, histogramOpts.Help, h.labelNames(), histogramOpts.ConstLabels)
+	h.loaded = func(labelValues []string, key sinceKey, value *MetricValue) bool {
+		if len(value.Buckets) != len(h.buckets) {
+			log.Printf("Warning: dropping value of %s saved with %d buckets instead of %d",
+				h.metricName, len(value.Buckets), len(h.buckets))
+			return false
+		}
+		return true
+	}
+	h.merge = sumHistograms
+	return h
+}
+
+func (h *Histogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *Histogram) Collect(ch chan<- prometheus.Metric) {
+	// Metrics are sent once unlocked, so that a slow receiver does not block
+	// observations.
+	var metrics []prometheus.Metric
+	h.mu.Lock()
+	for key, sinceMap := range h.sinceToValue {
+		for _, value := range sinceMap {
+			buckets := make(map[float64]uint64, len(h.buckets))
+			var cumulative uint64
+			for i, upperBound := range h.buckets {
+				cumulative += value.Buckets[i]
+				buckets[upperBound] = cumulative
+			}
+			metrics = append(metrics, prometheus.MustNewConstHistogram(h.desc, value.Count, value.Value, buckets,
+				h.prometheusLabelValues(value.Labels, key)...))
+		}
+	}
+	h.mu.Unlock()
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	h.collected()
+}
+
+func (h *Histogram) WithLabelValues(labelValues ...string) *HistogramWithLabels {
+	if h.sinceToValue == nil {
+		panic(errors.New("not initialized"))
+	}
+
+	newLabelValues := make([]string, len(labelValues))
+	copy(newLabelValues, labelValues)
+	return &HistogramWithLabels{
+		h:            h,
+		labelValues:  newLabelValues,
+		userLabelKey: userLabelKey(labelValues),
+	}
+}
+
+// Value returns the current value of the histogram for the given labels in
+// the period labelled since of the named window, with Buckets holding the
+// number of observations in each bucket. It is the zero value if there were
+// no observations.
+func (h *Histogram) Value(windowName, since string, labelValues ...string) MetricValue {
+	value, _ := h.value(windowName, since, labelValues)
+	value.Buckets = append([]uint64(nil), value.Buckets...)
+	return value
+}
+
+// Quantile estimates the q-quantile of the observations counted in value, a
+// value of the histogram, by interpolating linearly within its bucket.
+// Quantiles beyond the largest bucket are estimated as its upper bound.
+func (h *Histogram) Quantile(q float64, value MetricValue) float64 {
+	if value.Count == 0 || len(value.Buckets) != len(h.buckets) {
+		return 0
+	}
+	rank := q * float64(value.Count)
+	var cumulative float64
+	lowerBound := 0.0
+	for i, upperBound := range h.buckets {
+		count := float64(value.Buckets[i])
+		if cumulative+count >= rank && count > 0 {
+			return lowerBound + (upperBound-lowerBound)*(rank-cumulative)/count
+		}
+		cumulative += count
+		lowerBound = upperBound
+	}
+	return lowerBound
+}
+
+// Buckets returns the upper bounds of the buckets of the histogram.
+func (h *Histogram) Buckets() []float64 {
+	return append([]float64(nil), h.buckets...)
+}
+
+func (h *Histogram) Observe(since string, v float64) {
+	h.WithLabelValues().Observe(since, v)
+}
+
+func (h *Histogram) ObserveAt(t time.Time, v float64) {
+	h.WithLabelValues().ObserveAt(t, v)
+}
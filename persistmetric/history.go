@@ -0,0 +1,33 @@
+package persistmetric
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HistoryHandler serves the live and archived values of a metric as JSON.
+// The metric and window parameters select the metric and which of its
+// windows, e.g. metric=l4_total_bytes&window=day.
+func HistoryHandler(s *Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metric := s.metric(r.FormValue("metric"))
+		if metric == nil {
+			http.Error(w, "unknown metric", http.StatusNotFound)
+			return
+		}
+		windowName := r.FormValue("window")
+		if windowName == "" {
+			http.Error(w, "missing window", http.StatusBadRequest)
+			return
+		}
+		values, err := metric.base().History(windowName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(values)
+	})
+}
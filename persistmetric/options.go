@@ -3,6 +3,8 @@ package persistmetric
 import (
 	"errors"
 	"time"
+
+	"github.com/interarticle/bandwidth_recorder/window"
 )
 
 type options struct {
@@ -14,6 +16,12 @@ type options struct {
 	metricsBucketName string
 
 	variableLabels []string
+
+	legacyLabelValues []string
+
+	windows []*window.Window
+
+	retention []Tier
 }
 
 func defaultOptions() *options {
@@ -34,6 +42,13 @@ func (o *options) Copy() *options {
 
 	newOptions.variableLabels = make([]string, len(o.variableLabels))
 	copy(newOptions.variableLabels, o.variableLabels)
+	newOptions.legacyLabelValues = append([]string(nil), o.legacyLabelValues...)
+	if o.windows != nil {
+		newOptions.windows = append([]*window.Window(nil), o.windows...)
+	}
+	if o.retention != nil {
+		newOptions.retention = append([]Tier(nil), o.retention...)
+	}
 	return newOptions
 }
 
@@ -88,3 +103,27 @@ func VariableLabels(labels []string) Option {
 		return nil
 	}
 }
+
+// LegacyLabels migrates values saved before leading variable labels were
+// added to a metric: values saved with len(values) labels fewer than the
+// metric has are given values as their leading labels.
+func LegacyLabels(values ...string) Option {
+	return func(c *options) error {
+		c.legacyLabelValues = append([]string(nil), values...)
+		return nil
+	}
+}
+
+// Windows makes counters accumulate over each of the given windows at once,
+// adding a "window" label next to "since". Such counters are updated with
+// AddAt instead of Add.
+func Windows(windows ...*window.Window) Option {
+	return func(c *options) error {
+		if len(windows) == 0 {
+			return errors.New("at least one window is required")
+		}
+		c.windows = make([]*window.Window, len(windows))
+		copy(c.windows, windows)
+		return nil
+	}
+}
@@ -1,6 +1,7 @@
 package persistmetric
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,24 +10,36 @@ import (
 
 	"github.com/boltdb/bolt"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/window"
 )
 
 const (
 	metricsBucketName = "persistent-metrics"
+
+	// Values archived under a retention policy are kept in a bucket named
+	// after the metrics bucket with this suffix.
+	archiveBucketSuffix = "-archive"
 )
 
 type Storage struct {
 	db *bolt.DB
 
-	counters []*Counter
+	metrics   []persistedMetric
+	retention []Tier
 
 	options *options
 }
 
 type MetricValue struct {
 	Since  string   `json:"since"`
+	Window string   `json:"window,omitempty"`
 	Value  float64  `json:"value"`
 	Labels []string `json:"labels"`
+
+	// Only set for histograms, whose Value is the sum of observations.
+	Count   uint64   `json:"count,omitempty"`
+	Buckets []uint64 `json:"buckets,omitempty"`
 }
 
 type MetricValues []MetricValue
@@ -107,6 +120,215 @@ func (s *Storage) WriteMetric(metric string, values MetricValues) error {
 	})
 }
 
+// RetentionKeep returns how long past periods of the named window are kept
+// under the retention policy, or 0 if they are kept forever.
+func (s *Storage) RetentionKeep(windowName string) time.Duration {
+	for _, tier := range s.retention {
+		if tier.Window.Name() == windowName {
+			return tier.Keep
+		}
+	}
+	return 0
+}
+
+// recordBucketName returns the name of the bucket holding the records of
+// bucket, which are kept apart from metrics.
+func (s *Storage) recordBucketName(bucket string) []byte {
+	return []byte(s.options.metricsBucketName + "-" + bucket)
+}
+
+// WriteRecord saves values as the record key of bucket. Records are kept
+// apart from metrics, for data which is not exported as such.
+func (s *Storage) WriteRecord(bucket, key string, values MetricValues) error {
+	if s.db == nil {
+		return errors.New("not initialized")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.recordBucketName(bucket))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(&values)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// ReadRecords returns the records of bucket whose keys start with prefix, by
+// key.
+func (s *Storage) ReadRecords(bucket, prefix string) (map[string]MetricValues, error) {
+	if s.db == nil {
+		return nil, errors.New("not initialized")
+	}
+
+	result := make(map[string]MetricValues)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.recordBucketName(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, data := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, data = c.Next() {
+			var values MetricValues
+			err := json.Unmarshal(data, &values)
+			if err != nil {
+				return err
+			}
+			result[string(k)] = values
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListRecords returns the keys of the records of bucket in order.
+func (s *Storage) ListRecords(bucket string) ([]string, error) {
+	if s.db == nil {
+		return nil, errors.New("not initialized")
+	}
+
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.recordBucketName(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteRecords deletes the records of bucket whose keys start with prefix.
+func (s *Storage) DeleteRecords(bucket, prefix string) error {
+	if s.db == nil {
+		return errors.New("not initialized")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.recordBucketName(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Seek([]byte(prefix)) {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) archiveBucketName() []byte {
+	return []byte(s.options.metricsBucketName + archiveBucketSuffix)
+}
+
+// ReadArchive returns the values archived for a metric under a retention
+// policy.
+func (s *Storage) ReadArchive(metric string) (MetricValues, error) {
+	if s.db == nil {
+		return nil, errors.New("not initialized")
+	}
+
+	var result MetricValues
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.archiveBucketName())
+		data := b.Get([]byte(metric))
+		if data == nil {
+			return nil
+		}
+
+		return json.Unmarshal(data, &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListArchivedMetrics lists the metrics with archived values.
+func (s *Storage) ListArchivedMetrics() ([]string, error) {
+	if s.db == nil {
+		return nil, errors.New("not initialized")
+	}
+
+	var metrics []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.archiveBucketName()).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			metrics = append(metrics, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// writeArchive replaces the archive of a metric.
+func (s *Storage) writeArchive(metric string, archive MetricValues) error {
+	if s.db == nil {
+		return errors.New("not initialized")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(&archive)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(s.archiveBucketName()).Put([]byte(metric), data)
+	})
+}
+
+// writeMetricArchiving writes values like WriteMetric, and in the same
+// transaction replaces the archive of the metric by update applied to it.
+func (s *Storage) writeMetricArchiving(metric string, values MetricValues, update func(archive MetricValues) MetricValues) error {
+	if s.db == nil {
+		return errors.New("not initialized")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		archiveBucket := tx.Bucket(s.archiveBucketName())
+		var archive MetricValues
+		if data := archiveBucket.Get([]byte(metric)); data != nil {
+			err := json.Unmarshal(data, &archive)
+			if err != nil {
+				return err
+			}
+		}
+		archive = update(archive)
+		data, err := json.Marshal(&archive)
+		if err != nil {
+			return err
+		}
+		err = archiveBucket.Put([]byte(metric), data)
+		if err != nil {
+			return err
+		}
+
+		data, err = json.Marshal(&values)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(s.options.metricsBucketName)).Put([]byte(metric), data)
+	})
+}
+
 // Warning: not thread safe.
 func (s *Storage) NewCounter(counterOpts prometheus.Opts, opts ...Option) (*Counter, error) {
 	if s.db != nil {
@@ -119,7 +341,7 @@ func (s *Storage) NewCounter(counterOpts prometheus.Opts, opts ...Option) (*Coun
 		return nil, err
 	}
 	counter := newCounter(s, counterOpts, newOptions)
-	s.counters = append(s.counters, counter)
+	s.metrics = append(s.metrics, counter)
 	return counter, nil
 }
 
@@ -131,6 +353,125 @@ func (s *Storage) MustNewCounter(counterOpts prometheus.Opts, opts ...Option) *C
 	return counter
 }
 
+// Warning: not thread safe.
+func (s *Storage) NewGauge(gaugeOpts prometheus.Opts, opts ...Option) (*Gauge, error) {
+	if s.db != nil {
+		return nil, errors.New("must not add new gauge after initialization")
+	}
+
+	newOptions := s.options.Copy()
+	err := newOptions.Update(opts...)
+	if err != nil {
+		return nil, err
+	}
+	gauge := newGauge(s, gaugeOpts, newOptions)
+	s.metrics = append(s.metrics, gauge)
+	return gauge, nil
+}
+
+func (s *Storage) MustNewGauge(gaugeOpts prometheus.Opts, opts ...Option) *Gauge {
+	gauge, err := s.NewGauge(gaugeOpts, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return gauge
+}
+
+// Warning: not thread safe.
+func (s *Storage) NewHistogram(histogramOpts prometheus.HistogramOpts, opts ...Option) (*Histogram, error) {
+	if s.db != nil {
+		return nil, errors.New("must not add new histogram after initialization")
+	}
+	for i := 1; i < len(histogramOpts.Buckets); i++ {
+		if histogramOpts.Buckets[i] <= histogramOpts.Buckets[i-1] {
+			return nil, errors.New("histogram buckets must be in increasing order")
+		}
+	}
+
+	newOptions := s.options.Copy()
+	err := newOptions.Update(opts...)
+	if err != nil {
+		return nil, err
+	}
+	histogram := newHistogram(s, histogramOpts, newOptions)
+	s.metrics = append(s.metrics, histogram)
+	return histogram, nil
+}
+
+func (s *Storage) MustNewHistogram(histogramOpts prometheus.HistogramOpts, opts ...Option) *Histogram {
+	histogram, err := s.NewHistogram(histogramOpts, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return histogram
+}
+
+// metric returns the metric with the given fully-qualified name, or nil if
+// there is none.
+func (s *Storage) metric(name string) persistedMetric {
+	for _, metric := range s.metrics {
+		if metric.base().Name() == name {
+			return metric
+		}
+	}
+	return nil
+}
+
+// Counter returns the counter with the given fully-qualified name, or nil if
+// there is none.
+func (s *Storage) Counter(name string) *Counter {
+	counter, _ := s.metric(name).(*Counter)
+	return counter
+}
+
+// SetWindows replaces the windows of all metrics which were created with
+// the Windows option. It must be called before Initialize.
+func (s *Storage) SetWindows(windows ...*window.Window) error {
+	if s.db != nil {
+		return errors.New("must not set windows after initialization")
+	}
+	for _, metric := range s.metrics {
+		if !metric.base().windowed {
+			continue
+		}
+		err := metric.base().SetWindows(windows...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRetention sets the retention policy of all metrics which were created
+// with the Windows option. It must be called before Initialize.
+func (s *Storage) SetRetention(tiers ...Tier) error {
+	if s.db != nil {
+		return errors.New("must not set retention after initialization")
+	}
+	err := validateRetention(tiers)
+	if err != nil {
+		return err
+	}
+	s.retention = append([]Tier(nil), tiers...)
+	for _, metric := range s.metrics {
+		if metric.base().windowed {
+			metric.base().options.retention = append([]Tier(nil), tiers...)
+		}
+	}
+	return nil
+}
+
+// Save immediately writes the values of all metrics to the database.
+func (s *Storage) Save() error {
+	for _, metric := range s.metrics {
+		err := metric.base().saveMetrics()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Storage) Initialize(ctx context.Context, dbPath string) error {
 	if s.db != nil {
 		return errors.New("already initialized")
@@ -142,6 +483,10 @@ func (s *Storage) Initialize(ctx context.Context, dbPath string) error {
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(s.options.metricsBucketName))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(s.archiveBucketName())
 		return err
 	})
 	if err != nil {
@@ -149,8 +494,8 @@ func (s *Storage) Initialize(ctx context.Context, dbPath string) error {
 	}
 	s.db = db
 
-	for _, counter := range s.counters {
-		err := counter.loadSavedValues()
+	for _, metric := range s.metrics {
+		err := metric.base().loadSavedValues()
 		if err != nil {
 			return err
 		}
@@ -164,8 +509,8 @@ func (s *Storage) Initialize(ctx context.Context, dbPath string) error {
 			for {
 				select {
 				case <-ticker.C:
-					for _, counter := range s.counters {
-						err := counter.saveMetrics()
+					for _, metric := range s.metrics {
+						err := metric.base().saveMetrics()
 						if err != nil {
 							log.Printf("Warning: failed to save metrics periodically: %v", err)
 						}
@@ -0,0 +1,234 @@
+package persistmetric
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+// Tier is a level of a retention policy. Periods of its window that have
+// dropped out of the live values of a metric are archived, and kept for
+// Keep after they end, or forever if Keep is zero.
+type Tier struct {
+	Window *window.Window
+	Keep   time.Duration
+}
+
+func validateRetention(tiers []Tier) error {
+	names := make(map[string]bool)
+	for i, tier := range tiers {
+		if tier.Window == nil {
+			return errors.New("retention tier without a window")
+		}
+		if names[tier.Window.Name()] {
+			return fmt.Errorf("duplicate retention tier for window %q", tier.Window.Name())
+		}
+		names[tier.Window.Name()] = true
+		if i > 0 {
+			previous := tiers[i-1].Keep
+			if previous == 0 || (tier.Keep != 0 && tier.Keep < previous) {
+				return errors.New("retention tiers must go from finest to coarsest, each kept at least as long as the previous")
+			}
+		}
+	}
+	return nil
+}
+
+// Retention makes windowed metrics archive periods beyond the newest ones
+// they keep, per KeepNOldRecords, instead of deleting them. Tiers go from
+// the finest window to the coarsest: once a period of a tier expires, it is
+// rolled up into the period of the next tier's window containing it, unless
+// the metric accumulates over that window directly. Periods of windows
+// without a tier are archived forever.
+func Retention(tiers ...Tier) Option {
+	return func(c *options) error {
+		err := validateRetention(tiers)
+		if err != nil {
+			return err
+		}
+		c.retention = append([]Tier(nil), tiers...)
+		return nil
+	}
+}
+
+// parseKeep parses a duration, additionally accepting a number of days such
+// as "90d". An empty string means forever.
+func parseKeep(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// ParseRetention parses a comma separated list of tiers, each a window
+// specification as accepted by window.Parse, optionally followed by a colon
+// and how long to keep it, e.g. "hour:7d,day:90d,month".
+func ParseRetention(spec string) ([]Tier, error) {
+	var tiers []Tier
+	for _, tierSpec := range window.SplitList(spec) {
+		windowSpec, keepSpec := tierSpec, ""
+		if i := strings.LastIndex(tierSpec, ":"); i >= 0 && !strings.Contains(tierSpec[i:], ")") {
+			windowSpec, keepSpec = tierSpec[:i], strings.TrimSpace(tierSpec[i+1:])
+		}
+		w, err := window.Parse(windowSpec)
+		if err != nil {
+			return nil, err
+		}
+		keep, err := parseKeep(keepSpec)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, Tier{Window: w, Keep: keep})
+	}
+	return tiers, validateRetention(tiers)
+}
+
+type archiveKey struct {
+	sinceKey
+	userLabelKey string
+}
+
+// mergeValues merges values of the same period and labels.
+func (m *series) mergeValues(values MetricValues) map[archiveKey]*MetricValue {
+	merged := make(map[archiveKey]*MetricValue)
+	for i := range values {
+		value := values[i]
+		key := archiveKey{sinceKey{window: value.Window, since: value.Since}, userLabelKey(value.Labels)}
+		if existing, ok := merged[key]; ok {
+			m.merge(existing, value)
+		} else {
+			value.Buckets = append([]uint64(nil), value.Buckets...)
+			merged[key] = &value
+		}
+	}
+	return merged
+}
+
+func sortedValues(merged map[archiveKey]*MetricValue) MetricValues {
+	values := make(MetricValues, 0, len(merged))
+	for _, value := range merged {
+		values = append(values, *value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Window != values[j].Window {
+			return values[i].Window < values[j].Window
+		}
+		if values[i].Since != values[j].Since {
+			return values[i].Since < values[j].Since
+		}
+		return userLabelKey(values[i].Labels) < userLabelKey(values[j].Labels)
+	})
+	return values
+}
+
+func (m *series) isLiveWindow(name string) bool {
+	for _, w := range m.options.windows {
+		if w.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// latestStart returns the start of the newest of the live periods keys, which
+// is the time of the data saved, whether it is being recorded or replayed.
+func (m *series) latestStart(keys []sinceKey) time.Time {
+	var latest time.Time
+	for _, key := range keys {
+		for _, w := range m.options.windows {
+			if w.Name() != key.window {
+				continue
+			}
+			start, err := w.ParseSince(key.since)
+			if err == nil && start.After(latest) {
+				latest = start
+			}
+		}
+	}
+	return latest
+}
+
+// retain applies the retention policy of the metric at now to its archive,
+// rolling up and dropping expired periods.
+func (m *series) retain(archive MetricValues, now time.Time) MetricValues {
+	merged := m.mergeValues(archive)
+	tiers := m.options.retention
+	for i, tier := range tiers {
+		if tier.Keep == 0 {
+			continue
+		}
+		var next *window.Window
+		if i+1 < len(tiers) && !m.isLiveWindow(tiers[i+1].Window.Name()) {
+			next = tiers[i+1].Window
+		}
+		for key, value := range merged {
+			if key.window != tier.Window.Name() {
+				continue
+			}
+			start, err := tier.Window.ParseSince(key.since)
+			if err != nil {
+				log.Printf("Warning: keeping archived value of %s with invalid period %q: %v",
+					m.metricName, key.since, err)
+				continue
+			}
+			_, end := tier.Window.Bounds(start)
+			if now.Sub(end) < tier.Keep {
+				continue
+			}
+			delete(merged, key)
+			if next == nil {
+				continue
+			}
+			rolledKey := archiveKey{sinceKey{window: next.Name(), since: next.Since(start)}, key.userLabelKey}
+			if rolled, ok := merged[rolledKey]; ok {
+				m.merge(rolled, *value)
+			} else {
+				value.Since = rolledKey.since
+				value.Window = rolledKey.window
+				merged[rolledKey] = value
+			}
+		}
+	}
+	return sortedValues(merged)
+}
+
+// History returns the values of all series of the metric for every period
+// of the named window, both live and archived, ordered by period.
+func (m *series) History(windowName string) (MetricValues, error) {
+	archive, err := m.s.ReadArchive(m.metricName)
+	if err != nil {
+		return nil, err
+	}
+	var values MetricValues
+	for _, value := range archive {
+		if value.Window == windowName {
+			values = append(values, value)
+		}
+	}
+
+	m.mu.Lock()
+	for key, sinceMap := range m.sinceToValue {
+		if key.window != windowName {
+			continue
+		}
+		for _, value := range sinceMap {
+			values = append(values, *value)
+		}
+	}
+	m.mu.Unlock()
+
+	return sortedValues(m.mergeValues(values)), nil
+}
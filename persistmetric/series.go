@@ -0,0 +1,392 @@
+package persistmetric
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+const (
+	timeWindowStartLabelName = "since"
+	windowLabelName          = "window"
+
+	// Values saved before windows were introduced were always accumulated
+	// over calendar months, and are migrated to the window of this name if
+	// one is configured.
+	legacyWindowName = "month"
+)
+
+// sinceKey identifies one period of one window. window is empty for metrics
+// created without windows.
+type sinceKey struct {
+	window string
+	since  string
+}
+
+// persistedMetric is a metric whose values are kept in a Storage.
+type persistedMetric interface {
+	prometheus.Collector
+
+	base() *series
+}
+
+// series holds the values of a persisted metric per period and labels, and
+// implements what is common to all kinds of persisted metrics: loading,
+// compacting, archiving and saving the values.
+type series struct {
+	s *Storage
+
+	mu           sync.Mutex
+	name         string
+	metricName   string
+	sinceToValue map[sinceKey]map[string]*MetricValue
+
+	windowed bool
+	options  *options
+
+	// loaded is called with each value read from the database, and merge
+	// combines values of the same labels into one of a longer period when
+	// rolling up archived values.
+	loaded func(labelValues []string, key sinceKey, value *MetricValue) bool
+	merge  func(into *MetricValue, value MetricValue)
+}
+
+func userLabelKey(labels []string) string {
+	var buffer bytes.Buffer
+	for _, label := range labels {
+		buffer.WriteString(fmt.Sprintf("%d ", len(label)))
+		buffer.WriteString(label)
+	}
+	return buffer.String()
+}
+
+func newSeries(s *Storage, opts prometheus.Opts, options *options) series {
+	return series{
+		s: s,
+		name: prometheus.BuildFQName(opts.Namespace,
+			opts.Subsystem, opts.Name),
+		metricName: fmt.Sprintf("%s::%s::%s", opts.Namespace,
+			opts.Subsystem, opts.Name),
+		windowed: options.windows != nil,
+		options:  options,
+	}
+}
+
+func (m *series) base() *series {
+	return m
+}
+
+// labelNames returns the names of all labels of the metric, including the
+// window and since labels.
+func (m *series) labelNames() []string {
+	allLabels := append([]string(nil), m.options.variableLabels...)
+	if m.windowed {
+		allLabels = append(allLabels, windowLabelName)
+	}
+	return append(allLabels, timeWindowStartLabelName)
+}
+
+func (m *series) prometheusLabelValues(labelValues []string, key sinceKey) []string {
+	allValues := append([]string(nil), labelValues...)
+	if m.windowed {
+		allValues = append(allValues, key.window)
+	}
+	return append(allValues, key.since)
+}
+
+// keys returns the periods containing t in every window of the metric,
+// which must have been created with windows; method names the calling
+// method for the panic otherwise.
+func (m *series) keys(method string, t time.Time) []sinceKey {
+	if !m.windowed {
+		panic(fmt.Errorf("%s used on %s without windows", method, m.name))
+	}
+	var keys []sinceKey
+	for _, w := range m.options.windows {
+		keys = append(keys, sinceKey{window: w.Name(), since: w.Since(t)})
+	}
+	return keys
+}
+
+// key returns the period labelled since of a metric created without windows.
+func (m *series) key(method string, since string) sinceKey {
+	if m.windowed {
+		panic(fmt.Errorf("%s used on windowed %s; use %sAt", method, m.name, method))
+	}
+	return sinceKey{since: since}
+}
+
+// update calls f with the value of the given labels in the period key,
+// creating it if necessary, while holding the lock.
+func (m *series) update(labelValues []string, labelKey string, key sinceKey, f func(value *MetricValue, created bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sinceMap map[string]*MetricValue
+	var ok bool
+	if sinceMap, ok = m.sinceToValue[key]; !ok {
+		sinceMap = make(map[string]*MetricValue)
+		m.sinceToValue[key] = sinceMap
+	}
+	value, ok := sinceMap[labelKey]
+	if !ok {
+		value = &MetricValue{
+			Since:  key.since,
+			Window: key.window,
+			Value:  0,
+			Labels: labelValues,
+		}
+		sinceMap[labelKey] = value
+	}
+	f(value, !ok)
+}
+
+// SetWindows replaces the windows over which the metric accumulates. The
+// metric must have been created with the Windows option, and must not yet
+// be initialized.
+func (m *series) SetWindows(windows ...*window.Window) error {
+	if !m.windowed {
+		return fmt.Errorf("%s was created without windows", m.name)
+	}
+	if len(windows) == 0 {
+		return errors.New("at least one window is required")
+	}
+	if m.sinceToValue != nil {
+		return errors.New("must not set windows after initialization")
+	}
+	m.options.windows = append([]*window.Window(nil), windows...)
+	return nil
+}
+
+// SetLegacyLabels replaces the values given to the leading labels of values
+// saved without them, as with the LegacyLabels option. The metric must not
+// yet be initialized.
+func (m *series) SetLegacyLabels(values ...string) error {
+	if m.sinceToValue != nil {
+		return errors.New("must not set legacy labels after initialization")
+	}
+	m.options.legacyLabelValues = append([]string(nil), values...)
+	return nil
+}
+
+// VariableLabels returns the names of the variable labels of the metric.
+func (m *series) VariableLabels() []string {
+	return append([]string(nil), m.options.variableLabels...)
+}
+
+func (m *series) loadSavedValues() error {
+	if m.sinceToValue != nil {
+		return errors.New("already initialized")
+	}
+
+	values, err := m.s.ReadMetric(m.metricName)
+	if err != nil {
+		return err
+	}
+
+	m.sinceToValue = make(map[sinceKey]map[string]*MetricValue)
+	legacyWindow := m.legacyWindow()
+	for i := range values {
+		value := &values[i]
+		if m.windowed && value.Window == "" {
+			value.Window = legacyWindow
+		} else if !m.windowed && value.Window != "" {
+			log.Printf("Warning: dropping windowed value of %s saved for window %s",
+				m.metricName, value.Window)
+			continue
+		}
+		m.addLegacyLabels(value)
+		if len(value.Labels) != len(m.options.variableLabels) {
+			log.Printf("Warning: dropping value of %s saved with labels %v, which do not match %v",
+				m.metricName, value.Labels, m.options.variableLabels)
+			continue
+		}
+		key := sinceKey{window: value.Window, since: value.Since}
+		if !m.loaded(value.Labels, key, value) {
+			continue
+		}
+
+		var sinceMap map[string]*MetricValue
+		var ok bool
+		if sinceMap, ok = m.sinceToValue[key]; !ok {
+			sinceMap = make(map[string]*MetricValue)
+			m.sinceToValue[key] = sinceMap
+		}
+		sinceMap[userLabelKey(value.Labels)] = value
+	}
+	return m.migrateArchive()
+}
+
+// legacyWindow returns the name of the window values saved without one are
+// kept under: the calendar month window if configured, or else the first
+// window.
+func (m *series) legacyWindow() string {
+	if len(m.options.windows) == 0 || m.isLiveWindow(legacyWindowName) {
+		return legacyWindowName
+	}
+	return m.options.windows[0].Name()
+}
+
+// addLegacyLabels gives value the legacy label values as its leading labels
+// if it was saved without them, reporting whether it did.
+func (m *series) addLegacyLabels(value *MetricValue) bool {
+	legacy := m.options.legacyLabelValues
+	if len(legacy) == 0 || len(value.Labels)+len(legacy) != len(m.options.variableLabels) {
+		return false
+	}
+	value.Labels = append(append([]string(nil), legacy...), value.Labels...)
+	return true
+}
+
+// migrateArchive gives archived values the legacy label values like
+// loadSavedValues does live ones, saving the archive if any changed.
+func (m *series) migrateArchive() error {
+	if len(m.options.legacyLabelValues) == 0 {
+		return nil
+	}
+	archive, err := m.s.ReadArchive(m.metricName)
+	if err != nil {
+		return err
+	}
+	migrated := false
+	for i := range archive {
+		if m.addLegacyLabels(&archive[i]) {
+			migrated = true
+		}
+	}
+	if !migrated {
+		return nil
+	}
+	return m.s.writeArchive(m.metricName, archive)
+}
+
+// Name returns the fully-qualified Prometheus name of the metric.
+func (m *series) Name() string {
+	return m.name
+}
+
+// Values returns the current values of all series of the metric in the
+// period labelled since of the named window.
+func (m *series) Values(windowName, since string) MetricValues {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var values MetricValues
+	for _, value := range m.sinceToValue[sinceKey{window: windowName, since: since}] {
+		values = append(values, *value)
+	}
+	return values
+}
+
+// LiveValues returns the current values of all series of the metric in all
+// periods which have not been archived or deleted.
+func (m *series) LiveValues() MetricValues {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var values MetricValues
+	for _, sinceMap := range m.sinceToValue {
+		for _, value := range sinceMap {
+			copied := *value
+			copied.Buckets = append([]uint64(nil), value.Buckets...)
+			values = append(values, copied)
+		}
+	}
+	return values
+}
+
+// value returns a copy of the current value of the given labels in the
+// period labelled since of the named window.
+func (m *series) value(windowName, since string, labelValues []string) (MetricValue, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if value, ok := m.sinceToValue[sinceKey{window: windowName, since: since}][userLabelKey(labelValues)]; ok {
+		return *value, true
+	}
+	return MetricValue{}, false
+}
+
+func (m *series) saveMetrics() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sinceToValue == nil {
+		return errors.New("not initialized")
+	}
+
+	// Compact map, keeping the newest records of each window separately.
+	// Under a retention policy, older records are archived instead of
+	// deleted.
+	windowToSinces := make(map[string][]string)
+	for k := range m.sinceToValue {
+		windowToSinces[k.window] = append(windowToSinces[k.window], k.since)
+	}
+
+	archiving := m.windowed && m.options.retention != nil
+	var archived MetricValues
+	var keys, expired []sinceKey
+	for w, sinces := range windowToSinces {
+		sort.Strings(sinces)
+
+		if len(sinces) > m.options.numOldRecordsToKeep {
+			for _, since := range sinces[0 : len(sinces)-m.options.numOldRecordsToKeep] {
+				key := sinceKey{window: w, since: since}
+				if archiving {
+					for _, value := range m.sinceToValue[key] {
+						archived = append(archived, *value)
+					}
+				}
+				expired = append(expired, key)
+			}
+			sinces = sinces[len(sinces)-m.options.numOldRecordsToKeep : len(sinces)]
+		}
+		for _, since := range sinces {
+			keys = append(keys, sinceKey{window: w, since: since})
+		}
+	}
+
+	// Save metrics.
+	var values MetricValues
+	for _, key := range keys {
+		for _, value := range m.sinceToValue[key] {
+			values = append(values, *value)
+		}
+	}
+
+	var err error
+	if len(archived) > 0 {
+		// Retention is applied as of the data saved rather than the wall
+		// clock, so that replays of old captures are not pruned.
+		now := m.latestStart(keys)
+		err = m.s.writeMetricArchiving(m.metricName, values, func(archive MetricValues) MetricValues {
+			return m.retain(append(archive, archived...), now)
+		})
+	} else {
+		err = m.s.WriteMetric(m.metricName, values)
+	}
+	if err != nil {
+		// Expired records are kept until saved, so that they are archived
+		// by the next attempt rather than lost.
+		return err
+	}
+	for _, key := range expired {
+		delete(m.sinceToValue, key)
+	}
+	return nil
+}
+
+// collected saves the values of the metric in the background, as is done
+// whenever it is collected.
+func (m *series) collected() {
+	go func() {
+		err := m.saveMetrics()
+		if err != nil {
+			log.Printf("Warning: failed to save metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,312 @@
+// Package quota tracks usage against data caps over accounting windows, and
+// sends notifications when configured thresholds are crossed.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+const (
+	quotaLabelName = "quota"
+
+	// Prefix of the persisted metric which records the highest threshold
+	// already notified for each quota, so notifications are not repeated
+	// after a restart.
+	notifiedMetricPrefix = "quota::notified::"
+)
+
+var defaultThresholds = []float64{50, 80, 95}
+
+// Config describes a quota on a persistent counter.
+type Config struct {
+	Name string `json:"name"`
+	// Counter is the fully-qualified name of the counter whose usage is
+	// limited, e.g. "l4_total_bytes".
+	Counter string `json:"counter"`
+	// Labels selects a series of a counter with variable labels. For
+	// counters labelled by interface, the interface comes first; if it is
+	// left out, usage is summed over all interfaces.
+	Labels   []string `json:"labels"`
+	CapBytes float64  `json:"cap_bytes"`
+	// Window is a window specification, as accepted by window.Parse.
+	Window string `json:"window"`
+	// Thresholds are percentages of CapBytes at which to notify. Defaults
+	// to 50, 80 and 95.
+	Thresholds []float64    `json:"thresholds"`
+	Notify     []SinkConfig `json:"notify"`
+}
+
+// UsageFunc returns the number of bytes used in the period labelled since of
+// the named window.
+type UsageFunc func(windowName, since string) float64
+
+// Quota is a cap on usage within each period of a window.
+type Quota struct {
+	Name       string
+	CapBytes   float64
+	Window     *window.Window
+	Thresholds []float64
+	Usage      UsageFunc
+	Sinks      []Sink
+}
+
+// New builds a quota from its configuration. Usage is read from usage.
+func New(config Config, usage UsageFunc) (*Quota, error) {
+	if config.Name == "" {
+		return nil, errors.New("quota must have a name")
+	}
+	if config.CapBytes <= 0 {
+		return nil, fmt.Errorf("quota %s must have a positive cap", config.Name)
+	}
+	windowSpec := config.Window
+	if windowSpec == "" {
+		windowSpec = "month"
+	}
+	w, err := window.Parse(windowSpec)
+	if err != nil {
+		return nil, fmt.Errorf("quota %s: %v", config.Name, err)
+	}
+	thresholds := config.Thresholds
+	if thresholds == nil {
+		thresholds = defaultThresholds
+	}
+	thresholds = append([]float64(nil), thresholds...)
+	sort.Float64s(thresholds)
+
+	sinks := []Sink{LogSink{}}
+	if config.Notify != nil {
+		sinks = nil
+		for _, sinkConfig := range config.Notify {
+			sink, err := NewSink(sinkConfig)
+			if err != nil {
+				return nil, fmt.Errorf("quota %s: %v", config.Name, err)
+			}
+			sinks = append(sinks, sink)
+		}
+	}
+
+	return &Quota{
+		Name:       config.Name,
+		CapBytes:   config.CapBytes,
+		Window:     w,
+		Thresholds: thresholds,
+		Usage:      usage,
+		Sinks:      sinks,
+	}, nil
+}
+
+// Event describes a quota threshold being crossed.
+type Event struct {
+	Quota     string    `json:"quota"`
+	Window    string    `json:"window"`
+	Since     string    `json:"since"`
+	Time      time.Time `json:"time"`
+	Threshold float64   `json:"threshold_percent"`
+	UsedBytes float64   `json:"used_bytes"`
+	CapBytes  float64   `json:"cap_bytes"`
+	Percent   float64   `json:"used_percent"`
+	// ProjectedBytes is the usage expected by the end of the period if the
+	// average rate so far continues.
+	ProjectedBytes float64   `json:"projected_bytes"`
+	PeriodEnd      time.Time `json:"period_end"`
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("quota %s reached %.0f%% (%.0f of %.0f bytes, %.1f%%) in period since %s; projected %.0f bytes by %s",
+		e.Quota, e.Threshold, e.UsedBytes, e.CapBytes, e.Percent, e.Since,
+		e.ProjectedBytes, e.PeriodEnd.Format(time.RFC3339))
+}
+
+// Engine periodically evaluates quotas, exporting their state as Prometheus
+// gauges and notifying sinks of crossed thresholds.
+type Engine struct {
+	s *persistmetric.Storage
+
+	mu       sync.Mutex
+	quotas   []*Quota
+	notified map[string]persistmetric.MetricValue
+
+	capGauge       *prometheus.GaugeVec
+	usedGauge      *prometheus.GaugeVec
+	remainingGauge *prometheus.GaugeVec
+	percentGauge   *prometheus.GaugeVec
+	projectedGauge *prometheus.GaugeVec
+}
+
+// NewEngine creates an engine which records notification state in s.
+func NewEngine(s *persistmetric.Storage) *Engine {
+	newGaugeVec := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: help,
+		}, []string{quotaLabelName})
+	}
+	return &Engine{
+		s:              s,
+		notified:       make(map[string]persistmetric.MetricValue),
+		capGauge:       newGaugeVec("quota_cap_bytes", "Number of bytes allowed per period of the quota"),
+		usedGauge:      newGaugeVec("quota_used_bytes", "Number of bytes used in the current period of the quota"),
+		remainingGauge: newGaugeVec("quota_remaining_bytes", "Number of bytes remaining in the current period of the quota"),
+		percentGauge:   newGaugeVec("quota_used_percent", "Percentage of the quota used in the current period"),
+		projectedGauge: newGaugeVec("quota_projected_bytes", "Number of bytes projected to be used by the end of the current period of the quota"),
+	}
+}
+
+// Add registers a quota. It must be called before Run.
+func (e *Engine) Add(q *Quota) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.quotas = append(e.quotas, q)
+}
+
+func (e *Engine) Quotas() []*Quota {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Quota(nil), e.quotas...)
+}
+
+func (e *Engine) Describe(ch chan<- *prometheus.Desc) {
+	e.capGauge.Describe(ch)
+	e.usedGauge.Describe(ch)
+	e.remainingGauge.Describe(ch)
+	e.percentGauge.Describe(ch)
+	e.projectedGauge.Describe(ch)
+}
+
+func (e *Engine) Collect(ch chan<- prometheus.Metric) {
+	e.capGauge.Collect(ch)
+	e.usedGauge.Collect(ch)
+	e.remainingGauge.Collect(ch)
+	e.percentGauge.Collect(ch)
+	e.projectedGauge.Collect(ch)
+}
+
+// Run evaluates all quotas every interval until stop is closed. The storage
+// must already be initialized.
+func (e *Engine) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.Evaluate(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Evaluate updates the state of all quotas as of now, and sends
+// notifications for thresholds crossed since the last evaluation.
+func (e *Engine) Evaluate(now time.Time) {
+	for _, q := range e.Quotas() {
+		event := e.evaluate(q, now)
+		if event == nil {
+			continue
+		}
+		for _, sink := range q.Sinks {
+			go func(sink Sink, name string) {
+				err := sink.Notify(event)
+				if err != nil {
+					log.Printf("Warning: failed to send notification for quota %s: %v", name, err)
+				}
+			}(sink, q.Name)
+		}
+	}
+}
+
+func (e *Engine) evaluate(q *Quota, now time.Time) *Event {
+	start, end := q.Window.Bounds(now)
+	since := q.Window.Since(now)
+	used := q.Usage(q.Window.Name(), since)
+	percent := used / q.CapBytes * 100
+	remaining := q.CapBytes - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	projected := used
+	if elapsed := now.Sub(start); elapsed > 0 {
+		projected = used * float64(end.Sub(start)) / float64(elapsed)
+	}
+
+	e.capGauge.WithLabelValues(q.Name).Set(q.CapBytes)
+	e.usedGauge.WithLabelValues(q.Name).Set(used)
+	e.remainingGauge.WithLabelValues(q.Name).Set(remaining)
+	e.percentGauge.WithLabelValues(q.Name).Set(percent)
+	e.projectedGauge.WithLabelValues(q.Name).Set(projected)
+
+	// Only the highest threshold crossed is notified, once per period.
+	crossed := -1.0
+	for _, threshold := range q.Thresholds {
+		if percent >= threshold {
+			crossed = threshold
+		}
+	}
+	if crossed < 0 {
+		return nil
+	}
+	last, err := e.lastNotified(q)
+	if err != nil {
+		log.Printf("Warning: failed to read notification state of quota %s: %v", q.Name, err)
+		return nil
+	}
+	if last.Window == q.Window.Name() && last.Since == since && last.Value >= crossed {
+		return nil
+	}
+	err = e.setLastNotified(q, persistmetric.MetricValue{
+		Since:  since,
+		Window: q.Window.Name(),
+		Value:  crossed,
+	})
+	if err != nil {
+		log.Printf("Warning: failed to save notification state of quota %s: %v", q.Name, err)
+	}
+
+	return &Event{
+		Quota:          q.Name,
+		Window:         q.Window.Name(),
+		Since:          since,
+		Time:           now,
+		Threshold:      crossed,
+		UsedBytes:      used,
+		CapBytes:       q.CapBytes,
+		Percent:        percent,
+		ProjectedBytes: projected,
+		PeriodEnd:      end,
+	}
+}
+
+func (e *Engine) lastNotified(q *Quota) (persistmetric.MetricValue, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if value, ok := e.notified[q.Name]; ok {
+		return value, nil
+	}
+	values, err := e.s.ReadMetric(notifiedMetricPrefix + q.Name)
+	if err != nil {
+		return persistmetric.MetricValue{}, err
+	}
+	var value persistmetric.MetricValue
+	if len(values) > 0 {
+		value = values[0]
+	}
+	e.notified[q.Name] = value
+	return value, nil
+}
+
+func (e *Engine) setLastNotified(q *Quota, value persistmetric.MetricValue) error {
+	e.mu.Lock()
+	e.notified[q.Name] = value
+	e.mu.Unlock()
+	return e.s.WriteMetric(notifiedMetricPrefix+q.Name, persistmetric.MetricValues{value})
+}
@@ -0,0 +1,108 @@
+package quota
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const sinkTimeout = 30 * time.Second
+
+// Sink delivers quota notifications.
+type Sink interface {
+	Notify(event *Event) error
+}
+
+// SinkConfig selects and configures a sink. Type is one of "log", "exec" or
+// "webhook".
+type SinkConfig struct {
+	Type string `json:"type"`
+	// Command is the program and arguments run by exec sinks. Details of
+	// the event are passed in QUOTA_* environment variables.
+	Command []string `json:"command"`
+	// URL receives the event as a JSON POST request from webhook sinks.
+	URL string `json:"url"`
+}
+
+func NewSink(config SinkConfig) (Sink, error) {
+	switch config.Type {
+	case "log":
+		return LogSink{}, nil
+	case "exec":
+		if len(config.Command) == 0 {
+			return nil, errors.New("exec sink requires a command")
+		}
+		return &ExecSink{Command: config.Command}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, errors.New("webhook sink requires a URL")
+		}
+		return &WebhookSink{URL: config.URL}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+}
+
+// LogSink writes notifications to the standard logger.
+type LogSink struct{}
+
+func (LogSink) Notify(event *Event) error {
+	log.Print(event)
+	return nil
+}
+
+// ExecSink runs a command for each notification.
+type ExecSink struct {
+	Command []string
+}
+
+func (s *ExecSink) Notify(event *Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"QUOTA_NAME="+event.Quota,
+		"QUOTA_WINDOW="+event.Window,
+		"QUOTA_SINCE="+event.Since,
+		fmt.Sprintf("QUOTA_THRESHOLD_PERCENT=%g", event.Threshold),
+		fmt.Sprintf("QUOTA_USED_BYTES=%.0f", event.UsedBytes),
+		fmt.Sprintf("QUOTA_CAP_BYTES=%.0f", event.CapBytes),
+		fmt.Sprintf("QUOTA_USED_PERCENT=%.2f", event.Percent),
+		fmt.Sprintf("QUOTA_PROJECTED_BYTES=%.0f", event.ProjectedBytes),
+		"QUOTA_MESSAGE="+event.String(),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return nil
+}
+
+// WebhookSink POSTs each notification as JSON to a URL.
+type WebhookSink struct {
+	URL string
+}
+
+func (s *WebhookSink) Notify(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: sinkTimeout}
+	resp, err := client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+	"github.com/interarticle/bandwidth_recorder/quota"
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+// counterUsage reads quota usage from the series of counter selected by
+// labelValues. If the counter has an interface label and labelValues omit
+// it, usage is summed over all interfaces.
+func counterUsage(counter *persistmetric.Counter, labelValues []string) quota.UsageFunc {
+	labelNames := counter.VariableLabels()
+	if len(labelNames) == len(labelValues)+1 && labelNames[0] == interfaceLabelName {
+		return func(windowName, since string) float64 {
+			return sumInterfaces(counter.Values(windowName, since), labelValues)
+		}
+	}
+	return func(windowName, since string) float64 {
+		return counter.Value(windowName, since, labelValues...)
+	}
+}
+
+// addWindow appends w to windows unless an equal window is already present.
+// It fails if a different window of the same name is.
+func addWindow(windows []*window.Window, w *window.Window) ([]*window.Window, error) {
+	for _, existing := range windows {
+		if existing.Name() != w.Name() {
+			continue
+		}
+		if !existing.Equal(w) {
+			return nil, fmt.Errorf("window %q differs from another window of the same name", w.Name())
+		}
+		return windows, nil
+	}
+	return append(windows, w), nil
+}
+
+// setupQuotas adds the quotas in config to engine, returning windows
+// extended with any additional windows the quotas are measured over.
+func setupQuotas(config *recorderConfig, engine *quota.Engine, windows []*window.Window) ([]*window.Window, error) {
+	for _, quotaConfig := range config.Quotas {
+		counter := persistStorage.Counter(quotaConfig.Counter)
+		if counter == nil {
+			return nil, fmt.Errorf("quota %s: unknown counter %q", quotaConfig.Name, quotaConfig.Counter)
+		}
+		q, err := quota.New(quotaConfig, counterUsage(counter, quotaConfig.Labels))
+		if err != nil {
+			return nil, err
+		}
+		windows, err = addWindow(windows, q.Window)
+		if err != nil {
+			return nil, fmt.Errorf("quota %s: %v", quotaConfig.Name, err)
+		}
+		engine.Add(q)
+	}
+	return windows, nil
+}
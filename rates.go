@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/burst"
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+	"github.com/interarticle/bandwidth_recorder/window"
+)
+
+// Intervals over which WAN throughput is averaged.
+var rateIntervals = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1s", time.Second},
+	{"10s", 10 * time.Second},
+	{"1m", time.Minute},
+}
+
+// rateDirections are the directions whose throughput is tracked, in the
+// order of the byte counts of a rateSample.
+var rateDirections = []string{directionTx, directionRx}
+
+// Throughput percentiles are estimated from the average throughput of each
+// minute. As minutes are only counted in histogram buckets 20% apart, the
+// estimate may be off by up to 20%; burst billing computes exact percentiles
+// from its own samples.
+const (
+	rateSampleInterval = time.Minute
+	ratePercentile     = 0.95
+)
+
+type rateSample struct {
+	time  time.Time
+	bytes []uint64
+}
+
+// rateTracker computes the throughput of a WAN interface from the byte
+// counts flushed by its worker, keeping the samples of the longest interval.
+type rateTracker struct {
+	iface   string
+	samples []rateSample
+
+	// minute is the start of the minute whose bytes are counted in
+	// minuteBytes, by direction. minuteBytes is nil during the first minute,
+	// which is only seen in part.
+	minute      time.Time
+	minuteBytes []uint64
+}
+
+// rate returns the throughput in bytes per second over the given interval
+// up to the newest sample, or false if there are not enough samples yet.
+func (t *rateTracker) rate(direction int, interval time.Duration) (float64, bool) {
+	newest := t.samples[len(t.samples)-1].time
+	var bytes uint64
+	for i := len(t.samples) - 1; i > 0; i-- {
+		bytes += t.samples[i].bytes[direction]
+		if start := t.samples[i-1].time; newest.Sub(start) >= interval {
+			return float64(bytes) / newest.Sub(start).Seconds(), true
+		}
+	}
+	return 0, false
+}
+
+// observe adds the bytes transmitted in each direction since the previous
+// call, and updates the rate metrics.
+func (t *rateTracker) observe(now time.Time, bytes ...uint64) {
+	t.samples = append(t.samples, rateSample{time: now, bytes: bytes})
+	longest := rateIntervals[len(rateIntervals)-1].duration
+	for len(t.samples) > 2 && now.Sub(t.samples[1].time) >= longest {
+		t.samples = t.samples[1:]
+	}
+
+	for i, direction := range rateDirections {
+		for _, interval := range rateIntervals {
+			rate, ok := t.rate(i, interval.duration)
+			if !ok {
+				continue
+			}
+			wanL4RateGauge.WithLabelValues(t.iface, direction, interval.name).Set(rate)
+			wanL4PeakRateGauge.WithLabelValues(t.iface, direction, interval.name).SetMaxAt(now, rate)
+		}
+	}
+
+	// Each complete minute is observed once it ends, at its start so that it
+	// counts in the period it belongs to.
+	if minute := now.Truncate(rateSampleInterval); !minute.Equal(t.minute) {
+		if t.minuteBytes != nil {
+			for i, direction := range rateDirections {
+				rate := float64(t.minuteBytes[i]) / rateSampleInterval.Seconds()
+				wanL4RateHistogram.WithLabelValues(t.iface, direction).ObserveAt(t.minute, rate)
+			}
+		}
+		if !t.minute.IsZero() {
+			t.minuteBytes = make([]uint64, len(rateDirections))
+		}
+		t.minute = minute
+	}
+	if t.minuteBytes != nil {
+		for i := range t.minuteBytes {
+			t.minuteBytes[i] += bytes[i]
+		}
+	}
+}
+
+// percentileCollector exposes the throughput percentile of each period kept
+// by the persisted throughput histogram, as estimated from its buckets.
+type percentileCollector struct {
+	histogram *persistmetric.Histogram
+	desc      *prometheus.Desc
+}
+
+func (c *percentileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *percentileCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, value := range c.histogram.LiveValues() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			c.histogram.Quantile(ratePercentile, value),
+			append(append([]string(nil), value.Labels...), value.Window, value.Since)...)
+	}
+}
+
+var (
+	wanL4RateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "l4_rate_bytes_per_second",
+			Help: "Current Layer 4 throughput of an Internet interface, averaged over the given interval",
+		}, []string{interfaceLabelName, "direction", "interval"})
+	wanL4PeakRateGauge = persistStorage.MustNewGauge(prometheus.Opts{
+		Name: "l4_peak_rate_bytes_per_second",
+		Help: "Peak Layer 4 throughput of an Internet interface, averaged over the given interval",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "direction", "interval"}))
+	// Buckets grow by 20% from 1 KB/s, up to about 13 GB/s.
+	wanL4RateHistogram = persistStorage.MustNewHistogram(prometheus.HistogramOpts{
+		Name:    "l4_minute_rate_bytes_per_second",
+		Help:    "Distribution of the Layer 4 throughput of an Internet interface, averaged over each minute",
+		Buckets: prometheus.ExponentialBuckets(1000, 1.2, 90),
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "direction"}))
+	wanL4PercentileRateCollector = &percentileCollector{
+		histogram: wanL4RateHistogram,
+		desc: prometheus.NewDesc("l4_p95_rate_bytes_per_second",
+			"95th percentile of the Layer 4 throughput of an Internet interface, averaged over each minute, estimated to within 20%",
+			[]string{interfaceLabelName, "direction", "window", "since"}, nil),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(wanL4RateGauge)
+	prometheus.MustRegister(wanL4PeakRateGauge)
+	prometheus.MustRegister(wanL4RateHistogram)
+	prometheus.MustRegister(wanL4PercentileRateCollector)
+}
+
+// burstBilling is nil unless --burst_billing_window is set. It accounts the
+// WAN interface labelled burstBillingLabel.
+var (
+	burstBilling      *burst.Billing
+	burstBillingLabel string
+)
+
+func newBurstBilling() (*burst.Billing, error) {
+	w, err := window.Parse(*burstBillingWindow)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := burst.ParseMode(*burstBillingMode)
+	if err != nil {
+		return nil, err
+	}
+	billing, err := burst.New(persistStorage, burst.Config{
+		Window:         w,
+		Mode:           mode,
+		SampleInterval: *burstBillingInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	prometheus.MustRegister(billing)
+	return billing, nil
+}
+
+// flushBurstBilling saves the incomplete sample of burst billing, if enabled,
+// so that the traffic of the current interval is not lost on exit.
+func flushBurstBilling() {
+	if burstBilling == nil {
+		return
+	}
+	err := burstBilling.Flush()
+	if err != nil {
+		log.Printf("Warning: failed to save burst billing sample: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"github.com/interarticle/bandwidth_recorder/recording"
+)
+
+// wanRecorder is nil unless --record_path_prefix is set.
+var wanRecorder *recording.Writer
+
+// lastRecordError rate limits logging of recording failures, which would
+// otherwise repeat for every packet while e.g. the disk is full. It is
+// guarded by lastRecordErrorMu, as packets are recorded by concurrent readers.
+var (
+	lastRecordErrorMu sync.Mutex
+	lastRecordError   time.Time
+)
+
+func newRecorder() (*recording.Writer, error) {
+	return recording.NewWriter(recording.Config{
+		PathPrefix:     *recordPathPrefix,
+		RotateSize:     *recordRotateSize,
+		RotateInterval: *recordRotateInterval,
+		Format:         *recordFormat,
+		Compress:       *recordCompress,
+		IndexInterval:  *recordIndexInterval,
+	})
+}
+
+// recordPacket appends the metadata of packet to the recording if enabled.
+func recordPacket(packet gopacket.Packet) {
+	if wanRecorder == nil {
+		return
+	}
+	err := wanRecorder.Write(recording.FromPacket(packet))
+	if err == nil {
+		return
+	}
+	lastRecordErrorMu.Lock()
+	defer lastRecordErrorMu.Unlock()
+	if time.Since(lastRecordError) >= time.Minute {
+		log.Printf("Failed to record packet: %v", err)
+		lastRecordError = time.Now()
+	}
+}
+
+// flushRecording periodically writes buffered metadata out, so that an
+// ongoing recording can be analyzed and little is lost if the recorder dies.
+func flushRecording(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := wanRecorder.Flush()
+		if err != nil {
+			log.Printf("Failed to flush recording: %v", err)
+		}
+	}
+}
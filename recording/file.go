@@ -0,0 +1,244 @@
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/columnar"
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+	// last is the size of the last write. The gob encoder writes each
+	// message with a single write.
+	last int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.last = n
+	return n, err
+}
+
+// FileWriter writes metadata to a single recording file. It is not safe for
+// concurrent use.
+type FileWriter interface {
+	Write(m *data.PacketMetadata) error
+	// Size returns the number of bytes written to the file, including those
+	// still buffered.
+	Size() int64
+	// Flush writes buffered metadata to the file.
+	Flush() error
+	Close() error
+}
+
+// gobFileWriter writes a gob stream, and its index if indexInterval is
+// non-zero.
+type gobFileWriter struct {
+	indexInterval time.Duration
+
+	file       *os.File
+	fileSize   *countingWriter
+	gz         *gzip.Writer
+	buffer     *bufio.Writer
+	streamSize *countingWriter
+	encoder    *gob.Encoder
+
+	index        *os.File
+	segmentStart time.Time
+}
+
+func newGobFileWriter(file *os.File, compress bool, indexInterval time.Duration) (*gobFileWriter, error) {
+	w := &gobFileWriter{
+		indexInterval: indexInterval,
+		file:          file,
+		fileSize:      &countingWriter{w: file},
+	}
+	if indexInterval > 0 {
+		var err error
+		w.index, err = os.OpenFile(IndexPath(file.Name()), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var out io.Writer = w.fileSize
+	if compress {
+		w.gz = gzip.NewWriter(out)
+		out = w.gz
+	}
+	w.buffer = bufio.NewWriter(out)
+	w.streamSize = &countingWriter{w: w.buffer}
+	w.encoder = gob.NewEncoder(w.streamSize)
+	return w, nil
+}
+
+// columnarFlushAge is how long packets of a columnar file are buffered
+// before Flush writes them out in a chunk which is not full. Cutting chunks
+// on every periodic flush would leave them too small to compress well or to
+// be skipped by their stats.
+const columnarFlushAge = 5 * time.Minute
+
+// columnarFileWriter writes a columnar file, whose chunk stats make an index
+// unnecessary.
+type columnarFileWriter struct {
+	file   *os.File
+	writer *columnar.Writer
+	// bufferedSince is when the first packet still buffered was written.
+	bufferedSince time.Time
+}
+
+func newColumnarFileWriter(file *os.File, compress bool) (*columnarFileWriter, error) {
+	writer, err := columnar.NewWriter(file, columnar.Options{Compress: compress})
+	if err != nil {
+		return nil, err
+	}
+	return &columnarFileWriter{file: file, writer: writer}, nil
+}
+
+func (w *columnarFileWriter) Write(m *data.PacketMetadata) error {
+	if w.writer.Buffered() == 0 {
+		w.bufferedSince = time.Now()
+	}
+	return w.writer.Write(m)
+}
+
+func (w *columnarFileWriter) Size() int64 {
+	return w.writer.Size()
+}
+
+// Flush only writes buffered packets out once they have waited for
+// columnarFlushAge, as full chunks are written as they fill and Close
+// writes the rest.
+func (w *columnarFileWriter) Flush() error {
+	if w.writer.Buffered() == 0 || time.Since(w.bufferedSince) < columnarFlushAge {
+		return nil
+	}
+	return w.writer.Flush()
+}
+
+func (w *columnarFileWriter) Close() error {
+	err := w.writer.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newFileWriter(file *os.File, config Config) (FileWriter, error) {
+	switch config.Format {
+	case "", FormatGob:
+		return newGobFileWriter(file, config.Compress, config.IndexInterval)
+	case FormatColumnar:
+		return newColumnarFileWriter(file, config.Compress)
+	}
+	return nil, fmt.Errorf("unknown recording format %q", config.Format)
+}
+
+// Create creates a recording file at path, replacing any existing one, in
+// the format, compression and index interval of config.
+func Create(path string, config Config) (FileWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newFileWriter(file, config)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *gobFileWriter) writeIndex(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.index.Write(append(line, '\n'))
+	return err
+}
+
+// startSegment ends the current segment, so that the next packet starts at
+// a position that can be seeked to, and adds that to the index.
+func (w *gobFileWriter) startSegment(captureTime time.Time) error {
+	err := w.buffer.Flush()
+	if err != nil {
+		return err
+	}
+	if w.gz != nil {
+		err = w.gz.Close()
+		if err != nil {
+			return err
+		}
+		w.gz.Reset(w.fileSize)
+	}
+	w.segmentStart = captureTime
+	return w.writeIndex(&IndexEntry{Time: captureTime, Offset: w.fileSize.n})
+}
+
+func (w *gobFileWriter) Write(m *data.PacketMetadata) error {
+	if w.index == nil {
+		return w.encoder.Encode(m)
+	}
+	if w.streamSize.n == 0 {
+		// The first segment starts with the header, which is written
+		// along with the first packet.
+		err := w.encoder.Encode(m)
+		if err != nil {
+			return err
+		}
+		w.segmentStart = m.CaptureTime
+		err = w.writeIndex(&indexHeader{HeaderSize: w.streamSize.n - int64(w.streamSize.last)})
+		if err != nil {
+			return err
+		}
+		return w.writeIndex(&IndexEntry{Time: m.CaptureTime, Offset: 0})
+	}
+	if m.CaptureTime.Sub(w.segmentStart) >= w.indexInterval {
+		err := w.startSegment(m.CaptureTime)
+		if err != nil {
+			return err
+		}
+	}
+	return w.encoder.Encode(m)
+}
+
+func (w *gobFileWriter) Size() int64 {
+	return w.fileSize.n + int64(w.buffer.Buffered())
+}
+
+func (w *gobFileWriter) Flush() error {
+	err := w.buffer.Flush()
+	if err == nil && w.gz != nil {
+		err = w.gz.Flush()
+	}
+	return err
+}
+
+func (w *gobFileWriter) Close() error {
+	err := w.buffer.Flush()
+	if w.gz != nil {
+		if gzErr := w.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if w.index != nil {
+		if closeErr := w.index.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// IndexExtension is appended to the path of a recording to get that of its
+// index.
+const IndexExtension = ".idx"
+
+// An index is a sidecar file of JSON lines listing the segments of a
+// recording: the first line holds the header size, and each further line an
+// IndexEntry. Any segment but the first can be decoded by prefixing it with
+// the header, i.e. the gob type records at the start of the recording.
+
+type indexHeader struct {
+	HeaderSize int64 `json:"header_size"`
+}
+
+// IndexEntry locates the segment of a recording whose first packet was
+// captured at Time.
+type IndexEntry struct {
+	Time time.Time `json:"time"`
+	// Offset is the position in the file at which the segment starts. In
+	// compressed recordings, each segment is a separate gzip member.
+	Offset int64 `json:"offset"`
+}
+
+type Index struct {
+	// HeaderSize is the number of bytes of the uncompressed gob stream
+	// before the first packet.
+	HeaderSize int64
+	Entries    []IndexEntry
+}
+
+func IndexPath(recordingPath string) string {
+	return recordingPath + IndexExtension
+}
+
+// ReadIndex reads the index of the recording at recordingPath. A recording
+// still being written may have entries beyond the end of its data so far;
+// readers simply reach EOF early.
+func ReadIndex(recordingPath string) (*Index, error) {
+	file, err := os.Open(IndexPath(recordingPath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	var header indexHeader
+	err = decoder.Decode(&header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index of %s: %v", recordingPath, err)
+	}
+	index := &Index{HeaderSize: header.HeaderSize}
+	for {
+		var entry IndexEntry
+		err = decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A partially written last entry is dropped.
+			break
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+	return index, nil
+}
+
+// Range returns the span of the file holding all packets captured in
+// [from, to): start is the offset of the last segment starting at or before
+// from, and end that of the first segment starting after to, or -1 to read
+// to the end. A zero from or to leaves that side unbounded.
+func (index *Index) Range(from, to time.Time) (start, end int64) {
+	end = -1
+	for _, entry := range index.Entries {
+		if !from.IsZero() && !entry.Time.After(from) {
+			start = entry.Offset
+		}
+		if !to.IsZero() && entry.Time.After(to) {
+			end = entry.Offset
+			break
+		}
+	}
+	return start, end
+}
@@ -0,0 +1,59 @@
+// Package recording writes per-packet metadata recordings for offline
+// analysis by bandwidth_stats.
+package recording
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+func copyMAC(addr net.HardwareAddr) net.HardwareAddr {
+	return append(net.HardwareAddr(nil), addr...)
+}
+
+func copyIP(ip net.IP) net.IP {
+	return append(net.IP(nil), ip...)
+}
+
+// FromPacket extracts the metadata of a packet. Layer1 is its link layer,
+// usually Ethernet, Layer2 its network layer, IP, and Layer3 its transport
+// layer, TCP or UDP, so that VLAN tags and PPPoE headers between them are
+// skipped; their sizes are those of their headers.
+func FromPacket(packet gopacket.Packet) *data.PacketMetadata {
+	m := &data.PacketMetadata{
+		CaptureTime: packet.Metadata().Timestamp,
+		TotalSize:   packet.Metadata().Length,
+	}
+	if link := packet.LinkLayer(); link != nil {
+		m.Layer1Type, m.Layer1Size = link.LayerType(), len(link.LayerContents())
+		if eth, ok := link.(*layers.Ethernet); ok {
+			m.SrcMAC, m.DstMAC = copyMAC(eth.SrcMAC), copyMAC(eth.DstMAC)
+		}
+	}
+	if network := packet.NetworkLayer(); network != nil {
+		m.Layer2Type, m.Layer2Size = network.LayerType(), len(network.LayerContents())
+		switch l := network.(type) {
+		case *layers.IPv4:
+			m.SrcIP, m.DstIP = copyIP(l.SrcIP), copyIP(l.DstIP)
+		case *layers.IPv6:
+			m.SrcIP, m.DstIP = copyIP(l.SrcIP), copyIP(l.DstIP)
+		}
+	} else if arp := packet.Layer(layers.LayerTypeARP); arp != nil {
+		// ARP is not a network layer to gopacket, but takes the place of one.
+		m.Layer2Type, m.Layer2Size = arp.LayerType(), len(arp.LayerContents())
+	}
+	if transport := packet.TransportLayer(); transport != nil {
+		m.Layer3Type, m.Layer3Size = transport.LayerType(), len(transport.LayerContents())
+		switch l := transport.(type) {
+		case *layers.TCP:
+			m.SrcPort, m.DstPort = uint16(l.SrcPort), uint16(l.DstPort)
+		case *layers.UDP:
+			m.SrcPort, m.DstPort = uint16(l.SrcPort), uint16(l.DstPort)
+		}
+	}
+	return m
+}
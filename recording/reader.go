@@ -0,0 +1,105 @@
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+	"os"
+
+	"github.com/interarticle/bandwidth_recorder/columnar"
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// Decompress returns a reader over r, decompressing it if it is gzipped.
+func Decompress(r io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(gz), nil
+	}
+	return reader, nil
+}
+
+// IsColumnar reports whether r, as returned by Decompress, holds a columnar
+// recording rather than a gob stream.
+func IsColumnar(r io.Reader) bool {
+	peeker, ok := r.(interface {
+		Peek(n int) ([]byte, error)
+	})
+	if !ok {
+		return false
+	}
+	magic, _ := peeker.Peek(len(columnar.Magic))
+	return columnar.IsColumnar(magic)
+}
+
+// Reader decodes a recording of either format sequentially.
+type Reader struct {
+	decoder *gob.Decoder
+
+	chunks  *columnar.Reader
+	pending []data.PacketMetadata
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	if IsColumnar(reader) {
+		chunks, err := columnar.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{chunks: chunks}, nil
+	}
+	return &Reader{decoder: gob.NewDecoder(reader)}, nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the recording.
+func (r *Reader) Next() (*data.PacketMetadata, error) {
+	if r.chunks != nil {
+		for len(r.pending) == 0 {
+			chunk, err := r.chunks.Next(nil)
+			if err != nil {
+				return nil, err
+			}
+			r.pending, err = chunk.Decode()
+			if err != nil {
+				return nil, err
+			}
+		}
+		m := &r.pending[0]
+		r.pending = r.pending[1:]
+		return m, nil
+	}
+	m := &data.PacketMetadata{}
+	err := r.decoder.Decode(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Open opens the recording at path for sequential decoding; - is stdin.
+func Open(path string) (*Reader, io.Closer, error) {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	reader, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return reader, file, nil
+}
@@ -0,0 +1,148 @@
+package recording
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+const (
+	fileTimeFormat = "20060102T150405"
+
+	FormatGob      = "gob"
+	FormatColumnar = "columnar"
+
+	// Extensions of recording files; compressed gob files are additionally
+	// suffixed with ".gz", while columnar files compress each chunk.
+	Extension         = ".gob"
+	ColumnarExtension = ".col"
+)
+
+type Config struct {
+	// PathPrefix is the path of recording files up to the time they were
+	// started, e.g. /var/lib/bandwidth_recorder/wan gives files like
+	// /var/lib/bandwidth_recorder/wan-20060102T150405.gob.
+	PathPrefix string
+	// A new file is started once the current one reaches RotateSize bytes
+	// or has been open for RotateInterval. Zero disables either.
+	RotateSize     int64
+	RotateInterval time.Duration
+	// Format is FormatGob, the default, or FormatColumnar.
+	Format string
+	// Compress gzips each gob file, or compresses the chunks of columnar
+	// files.
+	Compress bool
+	// IndexInterval is the capture time covered by each segment listed in
+	// the index written alongside each gob file. Zero disables the index.
+	IndexInterval time.Duration
+}
+
+// Writer writes metadata to a series of gob files. Each file is a complete
+// gob stream, starting with its own type records, so files can be read
+// independently. It is safe for concurrent use.
+type Writer struct {
+	config Config
+
+	mu     sync.Mutex
+	file   FileWriter
+	opened time.Time
+}
+
+func NewWriter(config Config) (*Writer, error) {
+	if config.PathPrefix == "" {
+		return nil, fmt.Errorf("recording path prefix must be set")
+	}
+	if config.Format != "" && config.Format != FormatGob && config.Format != FormatColumnar {
+		return nil, fmt.Errorf("unknown recording format %q", config.Format)
+	}
+	return &Writer{config: config}, nil
+}
+
+func (w *Writer) openLocked(now time.Time) error {
+	base := w.config.PathPrefix + "-" + now.Format(fileTimeFormat)
+	suffix := Extension
+	if w.config.Format == FormatColumnar {
+		suffix = ColumnarExtension
+	} else if w.config.Compress {
+		suffix += ".gz"
+	}
+	// Rotating more than once a second would reuse a name, so number any
+	// further files started within the same second.
+	var file *os.File
+	var err error
+	for i := 0; ; i++ {
+		path := base + suffix
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d%s", base, i, suffix)
+		}
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	w.file, err = newFileWriter(file, w.config)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.opened = now
+	return nil
+}
+
+func (w *Writer) closeLocked() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) needsRotationLocked(now time.Time) bool {
+	if w.config.RotateSize > 0 && w.file.Size() >= w.config.RotateSize {
+		return true
+	}
+	return w.config.RotateInterval > 0 && now.Sub(w.opened) >= w.config.RotateInterval
+}
+
+// Write appends m to the current file, first starting a new one if due.
+func (w *Writer) Write(m *data.PacketMetadata) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if w.file != nil && w.needsRotationLocked(now) {
+		err := w.closeLocked()
+		if err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		err := w.openLocked(now)
+		if err != nil {
+			return err
+		}
+	}
+	return w.file.Write(m)
+}
+
+// Flush writes buffered metadata to the current file.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Flush()
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeLocked()
+}
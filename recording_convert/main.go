@@ -0,0 +1,176 @@
+// recording_convert converts packet metadata recordings to CSV, JSON Lines
+// or pcapng for other tools, and pcap or pcapng captures to recordings.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+	"github.com/interarticle/bandwidth_recorder/packetsource"
+	"github.com/interarticle/bandwidth_recorder/recording"
+)
+
+var (
+	input  = flag.String("input", "", "Comma-separated paths to recordings, optionally gzipped, or - for stdin; or, with --format=gob or columnar, the path to a pcap or pcapng capture.")
+	output = flag.String("output", "-", "Path of the converted file, or - for stdout.")
+	format = flag.String("format", "csv", "Format to convert to: csv, jsonl or pcapng, or gob or columnar for a recording from a capture or another recording. "+
+		"pcapng holds only the Ethernet, IP and TCP or UDP headers, with the original packet lengths.")
+	compress      = flag.Bool("compress", false, "Whether to compress recordings written with --format=gob or columnar.")
+	indexInterval = flag.Duration("index_interval", 0, "Granularity of the index written alongside recordings with --format=gob; 0 disables the index.")
+)
+
+type metadataWriter interface {
+	Write(m *data.PacketMetadata) error
+	Close() error
+}
+
+// isCapture reports whether the file at path is a pcap or pcapng capture.
+func isCapture(path string) (bool, error) {
+	if path == "-" || strings.Contains(path, ",") {
+		return false, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	var magic [4]byte
+	_, err = io.ReadFull(file, magic[:])
+	if err != nil {
+		return false, nil
+	}
+	switch binary.BigEndian.Uint32(magic[:]) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1, 0x0a0d0d0a:
+		return true, nil
+	}
+	return false, nil
+}
+
+func convertRecordings(w metadataWriter) error {
+	count := 0
+	for _, path := range strings.Split(*input, ",") {
+		reader, closer, err := recording.Open(path)
+		if err != nil {
+			return err
+		}
+		for {
+			m, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				closer.Close()
+				return err
+			}
+			err = w.Write(m)
+			if err != nil {
+				closer.Close()
+				return err
+			}
+			count++
+		}
+		closer.Close()
+	}
+	if p, ok := w.(*pcapngWriter); ok && p.skipped > 0 {
+		log.Printf("Skipped %d packets without an Ethernet header", p.skipped)
+	}
+	log.Printf("Converted %d packets", count)
+	return nil
+}
+
+func convertCapture(w metadataWriter) error {
+	src, err := packetsource.OpenFile(*input)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	count := 0
+	for {
+		packet, err := src.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = w.Write(recording.FromPacket(packet))
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	log.Printf("Converted %d packets", count)
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if *input == "" {
+		log.Fatal("you must specify --input")
+	}
+
+	var w metadataWriter
+	var out *os.File
+	var err error
+	switch *format {
+	case recording.FormatGob, recording.FormatColumnar:
+		if *output == "-" {
+			log.Fatalf("--format=%s needs --output to be a path", *format)
+		}
+		w, err = recording.Create(*output, recording.Config{
+			Format:        *format,
+			Compress:      *compress,
+			IndexInterval: *indexInterval,
+		})
+	case "csv", "jsonl", "pcapng":
+		out = os.Stdout
+		if *output != "-" {
+			out, err = os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		switch *format {
+		case "csv":
+			w, err = newCSVWriter(out)
+		case "jsonl":
+			w, err = newJSONLinesWriter(out)
+		case "pcapng":
+			w, err = newPcapngWriter(out)
+		}
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	capture, err := isCapture(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if capture {
+		if out != nil {
+			log.Fatalf("--format=%s only applies to recordings", *format)
+		}
+		err = convertCapture(w)
+	} else {
+		err = convertRecordings(w)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if out != nil {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
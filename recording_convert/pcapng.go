@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+var ipProtocols = map[gopacket.LayerType]layers.IPProtocol{
+	layers.LayerTypeTCP:    layers.IPProtocolTCP,
+	layers.LayerTypeUDP:    layers.IPProtocolUDP,
+	layers.LayerTypeICMPv4: layers.IPProtocolICMPv4,
+	layers.LayerTypeICMPv6: layers.IPProtocolICMPv6,
+	layers.LayerTypeGRE:    layers.IPProtocolGRE,
+	layers.LayerTypeSCTP:   layers.IPProtocolSCTP,
+	layers.LayerTypeIPv6:   layers.IPProtocolIPv6,
+}
+
+var zeroMAC = make(net.HardwareAddr, 6)
+
+func orZeroMAC(addr net.HardwareAddr) net.HardwareAddr {
+	if len(addr) != 6 {
+		return zeroMAC
+	}
+	return addr
+}
+
+// lengthField returns n as a 16 bit length field, clamped to its range, as
+// sizes derived from short or oversized records may not fit.
+func lengthField(n int) uint16 {
+	if n < 0 {
+		return 0
+	}
+	if n > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(n)
+}
+
+// synthesize rebuilds the headers of a recorded Ethernet packet. Length
+// fields hold the original lengths, while options and payloads, which are
+// not recorded, are left out. ok is false for other link types.
+func synthesize(m *data.PacketMetadata) (b []byte, ok bool) {
+	if m.Layer1Type != layers.LayerTypeEthernet {
+		return nil, false
+	}
+	eth := &layers.Ethernet{
+		SrcMAC: orZeroMAC(m.SrcMAC),
+		DstMAC: orZeroMAC(m.DstMAC),
+	}
+	stack := []gopacket.SerializableLayer{eth}
+	ipSize := m.TotalSize - m.Layer1Size
+	var network gopacket.NetworkLayer
+	switch {
+	case m.Layer2Type == layers.LayerTypeIPv4 && m.SrcIP.To4() != nil && m.DstIP.To4() != nil:
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Length:   lengthField(ipSize),
+			Protocol: ipProtocols[m.Layer3Type],
+			SrcIP:    m.SrcIP.To4(),
+			DstIP:    m.DstIP.To4(),
+		}
+		stack, network = append(stack, ip), ip
+	case m.Layer2Type == layers.LayerTypeIPv6 && m.SrcIP != nil && m.DstIP != nil:
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			Length:     lengthField(ipSize - 40),
+			NextHeader: ipProtocols[m.Layer3Type],
+			SrcIP:      m.SrcIP.To16(),
+			DstIP:      m.DstIP.To16(),
+		}
+		stack, network = append(stack, ip), ip
+	case m.Layer2Type == layers.LayerTypeARP:
+		eth.EthernetType = layers.EthernetTypeARP
+	}
+
+	if network != nil {
+		switch m.Layer3Type {
+		case layers.LayerTypeTCP:
+			stack = append(stack, &layers.TCP{
+				SrcPort:    layers.TCPPort(m.SrcPort),
+				DstPort:    layers.TCPPort(m.DstPort),
+				DataOffset: 5,
+			})
+		case layers.LayerTypeUDP:
+			stack = append(stack, &layers.UDP{
+				SrcPort: layers.UDPPort(m.SrcPort),
+				DstPort: layers.UDPPort(m.DstPort),
+				Length:  lengthField(ipSize - m.Layer2Size),
+			})
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, stack...)
+	if err != nil {
+		return nil, false
+	}
+	return buffer.Bytes(), true
+}
+
+type pcapngWriter struct {
+	w       *pcapgo.NgWriter
+	skipped int
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	ng, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapngWriter{w: ng}, nil
+}
+
+func (p *pcapngWriter) Write(m *data.PacketMetadata) error {
+	b, ok := synthesize(m)
+	if !ok {
+		p.skipped++
+		return nil
+	}
+	length := m.TotalSize
+	if length < len(b) {
+		length = len(b)
+	}
+	return p.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     m.CaptureTime,
+		CaptureLength: len(b),
+		Length:        length,
+	}, b)
+}
+
+func (p *pcapngWriter) Close() error {
+	return p.w.Flush()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/interarticle/bandwidth_recorder/data"
+)
+
+// row is the exported form of a PacketMetadata, with layer types named.
+type row struct {
+	CaptureTime time.Time `json:"capture_time"`
+	TotalSize   int       `json:"total_size"`
+	Layer1Type  string    `json:"layer1_type"`
+	Layer1Size  int       `json:"layer1_size"`
+	Layer2Type  string    `json:"layer2_type"`
+	Layer2Size  int       `json:"layer2_size"`
+	Layer3Type  string    `json:"layer3_type"`
+	Layer3Size  int       `json:"layer3_size"`
+	SrcMAC      string    `json:"src_mac,omitempty"`
+	DstMAC      string    `json:"dst_mac,omitempty"`
+	SrcIP       string    `json:"src_ip,omitempty"`
+	DstIP       string    `json:"dst_ip,omitempty"`
+	SrcPort     uint16    `json:"src_port,omitempty"`
+	DstPort     uint16    `json:"dst_port,omitempty"`
+}
+
+func formatMAC(addr net.HardwareAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func formatIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func toRow(m *data.PacketMetadata) *row {
+	return &row{
+		CaptureTime: m.CaptureTime,
+		TotalSize:   m.TotalSize,
+		Layer1Type:  m.Layer1Type.String(),
+		Layer1Size:  m.Layer1Size,
+		Layer2Type:  m.Layer2Type.String(),
+		Layer2Size:  m.Layer2Size,
+		Layer3Type:  m.Layer3Type.String(),
+		Layer3Size:  m.Layer3Size,
+		SrcMAC:      formatMAC(m.SrcMAC),
+		DstMAC:      formatMAC(m.DstMAC),
+		SrcIP:       formatIP(m.SrcIP),
+		DstIP:       formatIP(m.DstIP),
+		SrcPort:     m.SrcPort,
+		DstPort:     m.DstPort,
+	}
+}
+
+var csvHeader = []string{
+	"capture_time", "total_size",
+	"layer1_type", "layer1_size", "layer2_type", "layer2_size", "layer3_type", "layer3_size",
+	"src_mac", "dst_mac", "src_ip", "dst_ip", "src_port", "dst_port",
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	cw := csv.NewWriter(w)
+	return &csvWriter{cw}, cw.Write(csvHeader)
+}
+
+func (c *csvWriter) Write(m *data.PacketMetadata) error {
+	r := toRow(m)
+	return c.w.Write([]string{
+		r.CaptureTime.Format(time.RFC3339Nano), strconv.Itoa(r.TotalSize),
+		r.Layer1Type, strconv.Itoa(r.Layer1Size),
+		r.Layer2Type, strconv.Itoa(r.Layer2Size),
+		r.Layer3Type, strconv.Itoa(r.Layer3Size),
+		r.SrcMAC, r.DstMAC, r.SrcIP, r.DstIP,
+		strconv.Itoa(int(r.SrcPort)), strconv.Itoa(int(r.DstPort)),
+	})
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+func newJSONLinesWriter(w io.Writer) (*jsonLinesWriter, error) {
+	return &jsonLinesWriter{json.NewEncoder(w)}, nil
+}
+
+func (j *jsonLinesWriter) Write(m *data.PacketMetadata) error {
+	return j.encoder.Encode(toRow(m))
+}
+
+func (j *jsonLinesWriter) Close() error {
+	return nil
+}
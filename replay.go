@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/interarticle/bandwidth_recorder/packetsource"
+)
+
+// replayMain runs the accounting pipeline over the captures given by
+// --replay_pcap and --replay_lan_pcap, taken on the WAN and LAN interfaces in
+// order, then prints the resulting counters. If --database_path is set, the
+// counters are saved there as well, so a replay can be used to backfill
+// accounting.
+func replayMain(wanInterfaces, lanInterfaces []interfaceSpec) {
+	dbPath := *databasePath
+	if dbPath == "" {
+		tmpFile, err := ioutil.TempFile("", "bandwidth_recorder_replay")
+		if err != nil {
+			log.Fatal(err)
+		}
+		tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+		dbPath = tmpFile.Name()
+	}
+	err := persistStorage.Initialize(context.Background(), dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = replayCaptures(*replayPcap, wanInterfaces, *replayWanMAC, wanMonitoringWorker)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = replayCaptures(*replayLanPcap, lanInterfaces, *replayLanMAC, lanMonitoringWorker)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if wanFlows != nil {
+		flushFlows(wanFlows)
+	}
+	if exportFlows != nil {
+		exportFlows.Flush()
+		err = flowExporter.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if burstBilling != nil {
+		err = burstBilling.Flush()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if wanRecorder != nil {
+		err = wanRecorder.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = persistStorage.Save()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = printMetrics()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *listenSpec != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		log.Fatal(http.ListenAndServe(*listenSpec, nil))
+	}
+}
+
+// replayCaptures replays the comma separated captures in paths, each taken
+// on the interface at the same position in interfaces, with the hardware
+// address at the same position in macs if given.
+func replayCaptures(paths string, interfaces []interfaceSpec, macs string, worker func(*monitoredDevice, ...packetsource.Source) error) error {
+	if paths == "" {
+		return nil
+	}
+	macList := strings.Split(macs, ",")
+	for i, path := range strings.Split(paths, ",") {
+		if i >= len(interfaces) {
+			return fmt.Errorf("capture %s has no corresponding interface", path)
+		}
+		mac := ""
+		if i < len(macList) {
+			mac = macList[i]
+		}
+		err := replayCapture(path, interfaces[i], mac, worker)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayCapture(path string, spec interfaceSpec, mac string, worker func(*monitoredDevice, ...packetsource.Source) error) error {
+	dev, err := lookupDevice(spec, mac)
+	if err != nil {
+		return err
+	}
+	src, err := packetsource.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = packetsource.SetFilter(src, spec.config.Capture.FilterFor(src.LinkType()))
+	if err != nil {
+		return fmt.Errorf("filter of %v: %v", dev, err)
+	}
+	return worker(dev, src)
+}
+
+// printMetrics writes the recorder's own metrics to stdout in the Prometheus
+// text format.
+func printMetrics() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		name := family.GetName()
+		if strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_") ||
+			strings.HasPrefix(name, "promhttp_") {
+			continue
+		}
+		_, err := expfmt.MetricFamilyToText(os.Stdout, family)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/interarticle/bandwidth_recorder/persistmetric"
+)
+
+// labeledDeltas accumulates byte counts per label values between flushes to
+// a persistent counter, so that the packet loop does not contend on the
+// counter for every packet.
+type labeledDeltas struct {
+	mu     sync.Mutex
+	deltas map[string]uint64
+}
+
+// Label values never contain NUL, so it safely separates them in map keys.
+const labelSeparator = "\x00"
+
+func (d *labeledDeltas) add(n uint64, labelValues ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deltas == nil {
+		d.deltas = make(map[string]uint64)
+	}
+	d.deltas[strings.Join(labelValues, labelSeparator)] += n
+}
+
+func (d *labeledDeltas) flush(counter *persistmetric.Counter, now time.Time) {
+	d.mu.Lock()
+	deltas := d.deltas
+	d.deltas = nil
+	d.mu.Unlock()
+	for key, n := range deltas {
+		counter.WithLabelValues(strings.Split(key, labelSeparator)...).AddAt(now, float64(n))
+	}
+}
+
+type subnetConfig struct {
+	Name string `json:"name"`
+	CIDR string `json:"cidr"`
+}
+
+type namedSubnet struct {
+	name string
+	net  *net.IPNet
+}
+
+// subnetAccounting attributes WAN traffic to the local subnets, and
+// optionally the individual local addresses, it was sent from or to. This
+// works without MAC visibility, such as in routed setups.
+type subnetAccounting struct {
+	subnets []namedSubnet
+	perIP   bool
+
+	subnetTx, subnetRx labeledDeltas
+	ipTx, ipRx         labeledDeltas
+}
+
+func newSubnetAccounting(configs []subnetConfig, perIP bool) (*subnetAccounting, error) {
+	a := &subnetAccounting{perIP: perIP}
+	for _, config := range configs {
+		_, ipNet, err := net.ParseCIDR(config.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		name := config.Name
+		if name == "" {
+			name = ipNet.String()
+		}
+		a.subnets = append(a.subnets, namedSubnet{name: name, net: ipNet})
+	}
+	if len(a.subnets) == 0 {
+		return nil, fmt.Errorf("at least one subnet is required for subnet accounting")
+	}
+	return a, nil
+}
+
+// match returns the name of the first subnet containing ip, or "".
+func (a *subnetAccounting) match(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, subnet := range a.subnets {
+		if subnet.net.Contains(ip) {
+			return subnet.name
+		}
+	}
+	return ""
+}
+
+// observe accounts size bytes of a packet from srcIP to dstIP on the
+// interface labelled iface. Packets from a local subnet are sent (Tx), and
+// packets to one are received (Rx).
+func (a *subnetAccounting) observe(iface string, srcIP, dstIP net.IP, size uint64) {
+	if subnet := a.match(srcIP); subnet != "" {
+		a.subnetTx.add(size, iface, subnet)
+		if a.perIP {
+			a.ipTx.add(size, iface, srcIP.String())
+		}
+	} else if subnet := a.match(dstIP); subnet != "" {
+		a.subnetRx.add(size, iface, subnet)
+		if a.perIP {
+			a.ipRx.add(size, iface, dstIP.String())
+		}
+	}
+}
+
+func (a *subnetAccounting) flush(now time.Time) {
+	a.subnetTx.flush(wanL4SubnetTxBytesCounter, now)
+	a.subnetRx.flush(wanL4SubnetRxBytesCounter, now)
+	a.ipTx.flush(wanL4IPTxBytesCounter, now)
+	a.ipRx.flush(wanL4IPRxBytesCounter, now)
+}
+
+var (
+	wanL4SubnetTxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "wan_l4_subnet_tx_bytes",
+		Help: "Number of bytes sent to the Internet from a local subnet on Layer 4",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "subnet"}))
+	wanL4SubnetRxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "wan_l4_subnet_rx_bytes",
+		Help: "Number of bytes received from the Internet by a local subnet on Layer 4",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "subnet"}))
+	wanL4IPTxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "wan_l4_ip_tx_bytes",
+		Help: "Number of bytes sent to the Internet from a local IP address on Layer 4",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "ip_address"}))
+	wanL4IPRxBytesCounter = persistStorage.MustNewCounter(prometheus.Opts{
+		Name: "wan_l4_ip_rx_bytes",
+		Help: "Number of bytes received from the Internet by a local IP address on Layer 4",
+	}, persistmetric.VariableLabels([]string{interfaceLabelName, "ip_address"}))
+)
+
+func initSubnets(perIP bool) {
+	prometheus.MustRegister(wanL4SubnetTxBytesCounter)
+	prometheus.MustRegister(wanL4SubnetRxBytesCounter)
+	if perIP {
+		prometheus.MustRegister(wanL4IPTxBytesCounter)
+		prometheus.MustRegister(wanL4IPRxBytesCounter)
+	}
+}
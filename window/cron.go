@@ -0,0 +1,161 @@
+package window
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchLimit bounds how far Cron windows look for a matching time, so
+// that expressions which never match (e.g. February 30th) fail fast.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+type cronField uint64
+
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+func parseCronField(field string, min, max int) (cronField, error) {
+	var result cronField
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step != 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %q out of range [%d, %d]", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			result |= 1 << uint(v)
+		}
+	}
+	return result, nil
+}
+
+type cronBoundary struct {
+	minute, hour, dom, month, dow cronField
+	// As in cron, if both day fields are restricted, a day matches if
+	// either does.
+	domRestricted, dowRestricted bool
+}
+
+func (c *cronBoundary) dayMatches(t time.Time) bool {
+	domMatch := c.dom.has(t.Day())
+	dowMatch := c.dow.has(int(t.Weekday()))
+	if c.domRestricted && c.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func (c *cronBoundary) start(t time.Time) time.Time {
+	loc := t.Location()
+	limit := t.Add(-cronSearchLimit)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	for t.After(limit) {
+		switch {
+		case !c.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !c.hour.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(-time.Minute)
+		default:
+			return t
+		}
+	}
+	// Never matched; treat all time before the limit as one period.
+	return limit
+}
+
+func (c *cronBoundary) next(start time.Time) time.Time {
+	loc := start.Location()
+	limit := start.Add(cronSearchLimit)
+	t := time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), 0, 0, loc).Add(time.Minute)
+	for t.Before(limit) {
+		switch {
+		case !c.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !c.hour.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit
+}
+
+func (c *cronBoundary) format(start time.Time) string {
+	return start.Format("2006-01-02T15:04")
+}
+
+func (c *cronBoundary) parse(label string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02T15:04", label, loc)
+}
+
+// Cron returns a window whose periods start at each minute matched by the
+// standard 5-field cron expression expr (minute, hour, day of month, month,
+// day of week). Its labels use the "2006-01-02T15:04" format.
+func Cron(expr string, loc *time.Location) (*Window, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	c := &cronBoundary{}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 mean Sunday.
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow.has(7) {
+		c.dow |= 1
+	}
+	c.domRestricted = fields[2] != "*"
+	c.dowRestricted = fields[4] != "*"
+	w := newWindow("cron", loc, c)
+	w.kind = "cron(" + strings.Join(fields, " ") + ")"
+	return w, nil
+}
@@ -0,0 +1,357 @@
+// Package window divides time into consecutive accounting periods, such as
+// calendar months or billing cycles. Each period is identified by a "since"
+// label derived from its start time.
+package window
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type boundary interface {
+	// start returns the start of the period containing t. t is already in
+	// the window's location.
+	start(t time.Time) time.Time
+	// next returns the start of the period following the one starting at
+	// start.
+	next(start time.Time) time.Time
+	format(start time.Time) string
+	parse(label string, loc *time.Location) (time.Time, error)
+}
+
+type Window struct {
+	name string
+	// kind is the kind of the window with its argument, such as "billing17",
+	// and is the same for windows dividing time into the same periods.
+	kind     string
+	location *time.Location
+	boundary boundary
+
+	mu                     sync.Mutex
+	cachedStart, cachedEnd time.Time
+}
+
+func newWindow(name string, loc *time.Location, b boundary) *Window {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &Window{
+		name:     name,
+		kind:     name,
+		location: loc,
+		boundary: b,
+	}
+}
+
+// Name identifies the window, and is used as the "window" label of the
+// metrics accumulated over it.
+func (w *Window) Name() string {
+	return w.name
+}
+
+func (w *Window) Location() *time.Location {
+	return w.location
+}
+
+// Equal reports whether w and other have the same name, kind, argument and
+// location.
+func (w *Window) Equal(other *Window) bool {
+	return w.name == other.name && w.kind == other.kind && w.location.String() == other.location.String()
+}
+
+// Bounds returns the start (inclusive) and end (exclusive) of the period
+// containing t.
+func (w *Window) Bounds(t time.Time) (start, end time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !t.Before(w.cachedStart) && t.Before(w.cachedEnd) {
+		return w.cachedStart, w.cachedEnd
+	}
+	start = w.boundary.start(t.In(w.location))
+	end = w.boundary.next(start)
+	w.cachedStart, w.cachedEnd = start, end
+	return start, end
+}
+
+// Since returns the label of the period containing t.
+func (w *Window) Since(t time.Time) string {
+	start, _ := w.Bounds(t)
+	return w.boundary.format(start)
+}
+
+// ParseSince returns the start of the period identified by label.
+func (w *Window) ParseSince(label string) (time.Time, error) {
+	return w.boundary.parse(label, w.location)
+}
+
+func (w *Window) String() string {
+	return w.name
+}
+
+type layoutBoundary struct {
+	layout  string
+	startFn func(t time.Time) time.Time
+	nextFn  func(start time.Time) time.Time
+}
+
+func (b *layoutBoundary) start(t time.Time) time.Time {
+	return b.startFn(t)
+}
+
+func (b *layoutBoundary) next(start time.Time) time.Time {
+	return b.nextFn(start)
+}
+
+func (b *layoutBoundary) format(start time.Time) string {
+	return start.Format(b.layout)
+}
+
+func (b *layoutBoundary) parse(label string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation(b.layout, label, loc)
+}
+
+// CalendarMonth returns a window starting at midnight on the first of each
+// month. Its labels use the "2006-01" format.
+func CalendarMonth(loc *time.Location) *Window {
+	return newWindow("month", loc, &layoutBoundary{
+		layout: "2006-01",
+		startFn: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		},
+		nextFn: func(start time.Time) time.Time {
+			return time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, start.Location())
+		},
+	})
+}
+
+func daysIn(year int, month time.Month, loc *time.Location) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+}
+
+func billingStart(year int, month time.Month, day int, loc *time.Location) time.Time {
+	// Normalize the month first, so that daysIn sees a valid one.
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	if n := daysIn(first.Year(), first.Month(), loc); day > n {
+		day = n
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, loc)
+}
+
+// BillingDay returns a window starting at midnight on the given day of each
+// month. In months with fewer days, the period starts on the last day of the
+// month instead. Its labels use the "2006-01-02" format.
+func BillingDay(day int, loc *time.Location) (*Window, error) {
+	if day < 1 || day > 31 {
+		return nil, fmt.Errorf("invalid billing day %d", day)
+	}
+	return newWindow(fmt.Sprintf("billing%d", day), loc, &layoutBoundary{
+		layout: "2006-01-02",
+		startFn: func(t time.Time) time.Time {
+			start := billingStart(t.Year(), t.Month(), day, t.Location())
+			if t.Before(start) {
+				start = billingStart(t.Year(), t.Month()-1, day, t.Location())
+			}
+			return start
+		},
+		nextFn: func(start time.Time) time.Time {
+			return billingStart(start.Year(), start.Month()+1, day, start.Location())
+		},
+	}), nil
+}
+
+// Day returns a window starting at each midnight. Its labels use the
+// "2006-01-02" format.
+func Day(loc *time.Location) *Window {
+	return newWindow("day", loc, &layoutBoundary{
+		layout: "2006-01-02",
+		startFn: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		nextFn: func(start time.Time) time.Time {
+			return time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+		},
+	})
+}
+
+// Hour returns a window starting at the top of each hour. Its labels use the
+// "2006-01-02T15" format.
+func Hour(loc *time.Location) *Window {
+	return newWindow("hour", loc, &layoutBoundary{
+		layout: "2006-01-02T15",
+		startFn: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		},
+		nextFn: func(start time.Time) time.Time {
+			return time.Date(start.Year(), start.Month(), start.Day(), start.Hour()+1, 0, 0, 0, start.Location())
+		},
+	})
+}
+
+type isoWeekBoundary struct{}
+
+func (isoWeekBoundary) start(t time.Time) time.Time {
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+}
+
+func (isoWeekBoundary) next(start time.Time) time.Time {
+	return time.Date(start.Year(), start.Month(), start.Day()+7, 0, 0, 0, 0, start.Location())
+}
+
+func (isoWeekBoundary) format(start time.Time) string {
+	year, week := start.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", year, week)
+}
+
+func (b isoWeekBoundary) parse(label string, loc *time.Location) (time.Time, error) {
+	parts := strings.SplitN(label, "-W", 2)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("invalid ISO week %q", label)
+	}
+	year, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	week, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	if week < 1 || week > 53 {
+		return time.Time{}, fmt.Errorf("invalid ISO week %q", label)
+	}
+	// January 4th is always in week 1.
+	firstWeek := b.start(time.Date(year, time.January, 4, 0, 0, 0, 0, loc))
+	return time.Date(firstWeek.Year(), firstWeek.Month(), firstWeek.Day()+7*(week-1), 0, 0, 0, 0, loc), nil
+}
+
+// ISOWeek returns a window starting at midnight each Monday. Its labels use
+// the ISO 8601 week format, e.g. "2006-W01".
+func ISOWeek(loc *time.Location) *Window {
+	return newWindow("week", loc, isoWeekBoundary{})
+}
+
+// Parse parses a window specification of the form
+//
+//	[name=]kind[@timezone]
+//
+// where kind is one of month, day, week, hour, billing(N) for billing
+// cycles starting on day N of the month, or cron(EXPR) for periods starting
+// at each time matched by the 5-field cron expression EXPR. The timezone is
+// an IANA name such as America/New_York, and defaults to local time.
+func Parse(spec string) (*Window, error) {
+	spec = strings.TrimSpace(spec)
+	var name string
+	if i := strings.Index(spec, "="); i >= 0 && !strings.Contains(spec[:i], "(") {
+		name = strings.TrimSpace(spec[:i])
+		spec = strings.TrimSpace(spec[i+1:])
+		if name == "" {
+			return nil, errors.New("empty window name")
+		}
+	}
+
+	loc := time.Local
+	if i := strings.LastIndex(spec, "@"); i >= 0 && !strings.Contains(spec[i:], ")") {
+		var err error
+		loc, err = time.LoadLocation(strings.TrimSpace(spec[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		spec = strings.TrimSpace(spec[:i])
+	}
+
+	kind, arg := spec, ""
+	if i := strings.Index(spec, "("); i >= 0 {
+		if !strings.HasSuffix(spec, ")") {
+			return nil, fmt.Errorf("unbalanced parentheses in window %q", spec)
+		}
+		kind, arg = spec[:i], spec[i+1:len(spec)-1]
+	}
+
+	var w *Window
+	switch kind {
+	case "month":
+		w = CalendarMonth(loc)
+	case "day":
+		w = Day(loc)
+	case "week":
+		w = ISOWeek(loc)
+	case "hour":
+		w = Hour(loc)
+	case "billing":
+		day, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("invalid billing day %q: %v", arg, err)
+		}
+		w, err = BillingDay(day, loc)
+		if err != nil {
+			return nil, err
+		}
+	case "cron":
+		var err error
+		w, err = Cron(arg, loc)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown window kind %q", kind)
+	}
+	if name != "" {
+		w.name = name
+	}
+	return w, nil
+}
+
+// SplitList splits a comma separated list of window specifications, leaving
+// commas within parentheses, as in cron expressions, alone. Empty
+// specifications are dropped.
+func SplitList(specs string) []string {
+	var result []string
+	depth, begin := 0, 0
+	for i := 0; i <= len(specs); i++ {
+		if i < len(specs) {
+			switch specs[i] {
+			case '(':
+				depth++
+				continue
+			case ')':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		spec := strings.TrimSpace(specs[begin:i])
+		begin = i + 1
+		if spec != "" {
+			result = append(result, spec)
+		}
+	}
+	return result
+}
+
+// ParseList parses a comma separated list of window specifications, as
+// accepted by Parse. Window names must be unique.
+func ParseList(specs string) ([]*Window, error) {
+	var windows []*Window
+	names := make(map[string]bool)
+	for _, spec := range SplitList(specs) {
+		w, err := Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if names[w.Name()] {
+			return nil, fmt.Errorf("duplicate window name %q", w.Name())
+		}
+		names[w.Name()] = true
+		windows = append(windows, w)
+	}
+	return windows, nil
+}